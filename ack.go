@@ -0,0 +1,165 @@
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAckDeadline is how long a subscriber has to acknowledge a message
+// before it is redelivered, when no deadline is configured.
+const DefaultAckDeadline = 30 * time.Second
+
+// delivery tracks an unacknowledged message sent to a subscriber.
+type delivery struct {
+	broker     *Broker
+	subscriber *Subscriber
+	mutex      sync.Mutex // Guards the timer
+	timer      *time.Timer
+	settled    atomic.Bool
+}
+
+// track counts the message sent to the subscriber as unacknowledged. Its ack
+// deadline starts once it is handed to the subscriber, so messages waiting
+// in the queue of the subscriber are not redelivered.
+func (b *Broker) track(s *Subscriber, m *Message) {
+	if m.attempts == 0 {
+		m.attempts = 1
+	}
+	m.delivery = &delivery{broker: b, subscriber: s}
+	b.unacked.Add(1)
+}
+
+// start starts the ack deadline of the message, unless it is settled or
+// already started.
+func (d *delivery) start(m *Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.settled.Load() || d.timer != nil {
+		return
+	}
+	now := time.Now()
+	if m.firstDeliveredAt.IsZero() {
+		m.firstDeliveredAt = now
+	}
+	m.deliveredAt = now
+	d.timer = time.AfterFunc(d.broker.opt.AckDeadline, func() {
+		if m.settle() {
+			d.broker.retry(d.subscriber, m, ReasonAckDeadline)
+		}
+	})
+}
+
+// retry redelivers the message after a failed delivery, unless the message
+// has reached the maximum number of deliveries of the dead-letter policy of
+// the subscriber.
+func (b *Broker) retry(s *Subscriber, m *Message, reason string) {
+	b.retryAfter(s, m, reason, 0)
+}
+
+// retryAfter works like retry, but redelivers the message once the delay has
+// elapsed. A message reaching the maximum deliveries is dead-lettered right
+// away.
+func (b *Broker) retryAfter(s *Subscriber, m *Message, reason string, delay time.Duration) {
+	policy := s.opt.DeadLetter
+	if policy != nil && policy.MaxDeliveries > 0 && m.attempts >= policy.MaxDeliveries {
+		b.deadLetter(s, m, reason)
+		return
+	}
+	if delay <= 0 {
+		b.redeliver(s, m)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		b.redeliver(s, m)
+	})
+}
+
+// redeliver hands a new copy of the message to the subscriber, counting one
+// more delivery attempt. Once the subscriber is removed, a message delivered
+// through a consumer group goes to another member picked by the balancer of
+// the group, and other messages are not delivered.
+func (b *Broker) redeliver(s *Subscriber, m *Message) {
+	if s.closing() || !s.IsActive() {
+		if s = b.rebalance(s, m); s == nil {
+			m.discard()
+			return
+		}
+	}
+	next := m.clone()
+	next.attempts = m.attempts + 1
+	next.firstDeliveredAt = m.firstDeliveredAt
+	b.signal(s, next)
+}
+
+// rebalance returns the member of the consumer group of the message that
+// takes over from the removed subscriber, or nil.
+func (b *Broker) rebalance(removed *Subscriber, m *Message) *Subscriber {
+	if m.group == nil {
+		return nil
+	}
+	member := m.group.balancer.Pick(m)
+	if member == nil || member == removed || member.closing() || !member.IsActive() {
+		return nil
+	}
+	return member
+}
+
+// settle stops tracking the message. It reports false when the message was
+// already settled or is not tracked.
+func (m *Message) settle() bool {
+	d := m.delivery
+	if d == nil || !d.settled.CompareAndSwap(false, true) {
+		return false
+	}
+	d.mutex.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.mutex.Unlock()
+	d.broker.unacked.Add(-1)
+	return true
+}
+
+// Ack acknowledges the message, so the broker stops redelivering it.
+//
+// Ack has no effect when the broker does not track acknowledgements or when
+// the message is already acknowledged, rejected or expired.
+func (m *Message) Ack() {
+	if m.settle() {
+		m.ticket.release()
+	}
+}
+
+// Nack rejects the message. When requeue is true, the message is redelivered
+// to the same subscriber immediately with one more delivery attempt, unless
+// it has reached the maximum deliveries of the dead-letter policy. Otherwise
+// the message is dead-lettered when a dead-letter policy applies, or
+// discarded.
+//
+// Nack has no effect when the broker does not track acknowledgements or when
+// the message is already acknowledged, rejected or expired.
+func (m *Message) Nack(requeue bool) {
+	m.fail(requeue, 0, ReasonRejected)
+}
+
+// fail settles the message as failed for the given reason, then retries it
+// once the delay has elapsed, or dead-letters it.
+func (m *Message) fail(requeue bool, delay time.Duration, reason string) {
+	if !m.settle() {
+		return
+	}
+	d := m.delivery
+	if requeue {
+		d.broker.retryAfter(d.subscriber, m, reason, delay)
+	} else {
+		d.broker.deadLetter(d.subscriber, m, reason)
+	}
+}
+
+// Unacked returns the number of delivered messages waiting for an
+// acknowledgement.
+func (b *Broker) Unacked() int {
+	return int(b.unacked.Load())
+}
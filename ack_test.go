@@ -0,0 +1,180 @@
+package pubsub_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_Ack(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		AtLeastOnce: true,
+		AckDeadline: 20 * time.Millisecond,
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	broker.Publish("orders", "created")
+
+	msg := <-sub.GetMessages()
+	require.Equal(t, 1, msg.GetAttempts())
+	require.Equal(t, 1, broker.Unacked())
+
+	msg.Ack()
+	msg.Ack()
+	require.Equal(t, 0, broker.Unacked())
+	require.Empty(t, drain(sub))
+}
+
+func Test_AckDeadline(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		AtLeastOnce: true,
+		AckDeadline: 30 * time.Millisecond,
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	broker.Publish("orders", "created")
+
+	first := <-sub.GetMessages()
+	second := <-sub.GetMessages()
+	require.Equal(t, "created", second.GetContent())
+	require.Equal(t, 2, second.GetAttempts())
+
+	// The expired delivery can no longer be acknowledged.
+	first.Ack()
+	require.Equal(t, 1, broker.Unacked())
+	second.Ack()
+	require.Equal(t, 0, broker.Unacked())
+}
+
+func Test_Nack(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		AtLeastOnce: true,
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	broker.Publish("orders", "created")
+
+	msg := <-sub.GetMessages()
+	msg.Nack(true)
+	msg = <-sub.GetMessages()
+	require.Equal(t, 2, msg.GetAttempts())
+
+	msg.Nack(false)
+	require.Equal(t, 0, broker.Unacked())
+	require.Empty(t, drain(sub))
+}
+
+func Test_AckDisabled(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	broker.Publish("orders", "created")
+
+	msg := <-sub.GetMessages()
+	require.Equal(t, 0, msg.GetAttempts())
+	msg.Nack(true)
+	require.Empty(t, drain(sub))
+}
+
+func Test_AckDropped(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		AtLeastOnce: true,
+		AckDeadline: 30 * time.Millisecond,
+		BufferSize:  2,
+		Overflow:    pubsub.OverflowDropNewest,
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	for i := range 10 {
+		broker.Publish("orders", i)
+	}
+	require.Positive(t, sub.Dropped())
+
+	// The dropped messages are redelivered once their ack deadline expires.
+	received := map[any]bool{}
+	timeout := time.After(2 * time.Second)
+	for len(received) < 10 {
+		select {
+		case msg := <-sub.GetMessages():
+			received[msg.GetContent()] = true
+			msg.Ack()
+		case <-timeout:
+			t.Fatalf("received %d of 10 messages", len(received))
+		}
+	}
+	require.Eventually(t, func() bool {
+		for {
+			select {
+			case msg := <-sub.GetMessages():
+				msg.Ack()
+			default:
+				return broker.Unacked() == 0
+			}
+		}
+	}, time.Second, 5*time.Millisecond)
+}
+
+func Test_AckBlock(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{AtLeastOnce: true, BufferSize: 1})
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+
+	// Publishers wait for a slow subscriber longer than DefaultBlockTimeout
+	// rather than drop its messages.
+	go func() {
+		for i := range 4 {
+			broker.Publish("orders", i)
+		}
+	}()
+	time.Sleep(2 * pubsub.DefaultBlockTimeout)
+	for i := range 4 {
+		select {
+		case msg := <-sub.GetMessages():
+			require.Equal(t, i, msg.GetContent())
+			msg.Ack()
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of 4 messages", i)
+		}
+	}
+	require.Zero(t, sub.Dropped())
+}
+
+func Test_AckDeadlineQueued(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		AtLeastOnce: true,
+		AckDeadline: 50 * time.Millisecond,
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	for i := range 5 {
+		broker.Publish("orders", i)
+	}
+
+	// The deadline starts when the subscriber receives a message, not while
+	// it waits in the queue.
+	time.Sleep(150 * time.Millisecond)
+	for i := range 5 {
+		msg := <-sub.GetMessages()
+		require.Equal(t, i, msg.GetContent())
+		require.Equal(t, 1, msg.GetAttempts())
+		msg.Ack()
+	}
+	require.Empty(t, drain(sub))
+	require.Equal(t, 0, broker.Unacked())
+
+	// Queued messages of a removed subscriber are no longer waiting for an
+	// acknowledgement.
+	broker.Publish("orders", "queued")
+	broker.Publish("orders", "queued")
+	require.Equal(t, 2, broker.Unacked())
+	broker.RemoveSubscriber(sub)
+	require.Equal(t, 0, broker.Unacked())
+}
@@ -2,26 +2,102 @@ package pubsub
 
 import (
 	"fmt"
+	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Subscribers map[string]*Subscriber
 
+// DeliveryMode decides how published messages are handed to subscribers.
+type DeliveryMode int
+
+const (
+	// DeliveryOrdered queues messages per subscriber and dispatches them from
+	// a single loop, so a subscriber receives the messages of one publisher in
+	// publish order. This is the default.
+	DeliveryOrdered DeliveryMode = iota
+	// DeliveryConcurrent hands messages straight to the buffer of each
+	// subscriber, a message waiting for free space is sent from its own
+	// goroutine. Messages published back to back may be received in any order.
+	DeliveryConcurrent
+)
+
 type BrokerOptions struct {
-	// set this to `true` to use wildcards
+	// set this to `true` to use wildcards, `*` matches one segment and `#` or
+	// `**` match any number of segments
 	Wildcard bool
-	// the delimiter used to segment namespaces
+	// the delimiter used to segment namespaces, defaults to "."
 	Delimiter string
 	// the maximum number of subscribers per topic
 	MaxSubscribers int
+	// the number of messages buffered per subscriber, defaults to DefaultBufferSize
+	BufferSize int
+	// what to do when a subscriber's buffer is full, defaults to OverflowBlock
+	Overflow OverflowPolicy
+	// how long OverflowBlock waits for free space, defaults to
+	// DefaultBlockTimeout, a negative timeout waits until the subscriber is
+	// removed; with AtLeastOnce, and for the subscribers of Handler, the
+	// default is to wait until the subscriber is removed
+	BlockTimeout time.Duration
+	// called for every message dropped by any subscriber
+	OnDrop DropHandler
+	// how messages are handed to subscribers, defaults to DeliveryOrdered
+	Delivery DeliveryMode
+	// creates the balancer of each consumer group, defaults to RoundRobin
+	Balancer func() Balancer
+	// set this to `true` to redeliver messages until they are acknowledged
+	AtLeastOnce bool
+	// how long a subscriber has to acknowledge a message before it is
+	// redelivered, defaults to DefaultAckDeadline
+	AckDeadline time.Duration
+	// where messages that keep failing are sent, nil keeps redelivering them
+	DeadLetter *DeadLetterPolicy
+	// persists published messages until they are delivered, nil keeps them
+	// in memory only
+	Store Store
+	// encodes the payloads of persisted messages, defaults to JSONCodec
+	Codec Codec
+	// the default TTL of the messages published to each topic
+	TopicTTL map[string]time.Duration
+	// where messages expiring before reaching a subscriber are published,
+	// empty drops them
+	ExpiryTopic string
+	// called for every message expiring before reaching a subscriber
+	OnExpire ExpireHandler
+	// how long an idempotency key suppresses duplicates, defaults to
+	// DefaultDedupWindow
+	DedupWindow time.Duration
+	// the maximum number of idempotency keys remembered, defaults to
+	// DefaultDedupMaxKeys
+	DedupMaxKeys int
 }
 
 type Broker struct {
 	subscribers Subscribers
 	topics      map[string]Subscribers
+	trie        *topicTrie
+	matchers    map[string]func(topic string) bool
+	matchCache  *matchCache
+	groups      map[string]map[string]*group
 	mutex       sync.RWMutex
 	opt         BrokerOptions
+	dropped     atomic.Uint64
+	expired     atomic.Uint64
+	dedup       *dedupCache
+	duplicates  atomic.Uint64
+	ttls        map[string]time.Duration
+	unacked     atomic.Int64
+	deadLetters *deadLetterStore
+	retained    *retainStore
+	durables    *durables
+	journal     *journal
+	streams     map[string]*stream
+	scheduler   *scheduler
+	crons       map[string]*cronJob
+	closed      atomic.Bool
 }
 
 // NewBroker returns a new instance of Broker.
@@ -32,12 +108,58 @@ type Broker struct {
 // When a subscriber subscribes to a topic, the subscriber is added to a list
 // of subscribers for that topic. When a message is published to a topic, all
 // subscribers of that topic will receive the message.
+//
+// When wildcards are enabled, subscribed topics are indexed in a trie keyed by
+// the delimiter separated segments of the topic.
+//
+// When a Store is configured, published messages are persisted until they are
+// delivered. Call Recover once the subscribers are set up to deliver the
+// messages a previous run left in the store.
 func NewBroker(opt BrokerOptions) *Broker {
+	if opt.Delimiter == "" {
+		opt.Delimiter = "."
+	}
+	if opt.AckDeadline <= 0 {
+		opt.AckDeadline = DefaultAckDeadline
+	}
+
 	broker := &Broker{
 		subscribers: Subscribers{},
 		topics:      map[string]Subscribers{},
+		matchers:    map[string]func(topic string) bool{},
+		matchCache:  newMatchCache(),
+		groups:      map[string]map[string]*group{},
+		deadLetters: newDeadLetterStore(),
+		retained:    newRetainStore(),
+		durables:    newDurables(),
+		streams:     map[string]*stream{},
+		crons:       map[string]*cronJob{},
+		ttls:        map[string]time.Duration{},
+		dedup:       newDedupCache(opt.DedupWindow, opt.DedupMaxKeys),
 		opt:         opt,
 	}
+	if opt.Wildcard {
+		broker.trie = newTopicTrie(opt.Delimiter)
+	}
+	for topic, ttl := range opt.TopicTTL {
+		broker.SetTopicTTL(topic, ttl)
+	}
+	if opt.Store != nil {
+		if opt.Codec == nil {
+			opt.Codec = JSONCodec{}
+		}
+		broker.journal = newJournal(opt.Store, opt.Codec, &broker.closed, broker.durables)
+		if err := broker.journal.load(); err != nil {
+			log.Printf("pubsub: load store: %v\n", err)
+		}
+		if err := broker.journal.loadCheckpoints(); err != nil {
+			log.Printf("pubsub: load durable subscriptions: %v\n", err)
+		}
+	}
+	broker.scheduler = newScheduler(broker)
+	if err := broker.scheduler.load(); err != nil {
+		log.Printf("pubsub: load scheduled messages: %v\n", err)
+	}
 
 	return broker
 }
@@ -47,37 +169,221 @@ func NewBroker(opt BrokerOptions) *Broker {
 // The subscriber is created and registered with the broker. The subscriber
 // can then be used to subscribe to topics and receive messages.
 //
-// The subscriber is returned by AddSubscriber.
-func (b *Broker) AddSubscriber() *Subscriber {
+// The first options, if given, override the buffer size and overflow policy
+// configured in BrokerOptions for this subscriber only.
+//
+// The subscriber is returned by AddSubscriber. It is nil when the subscriber
+// could not be added; use TryAddSubscriber to know why.
+func (b *Broker) AddSubscriber(opts ...SubscriberOptions) *Subscriber {
+	s, _ := b.TryAddSubscriber(opts...)
+	return s
+}
+
+// TryAddSubscriber creates a new subscriber and adds it to the broker.
+//
+// It returns ErrBrokerClosed when the broker is shut down and
+// ErrMaxSubscribers when the broker already has MaxSubscribers subscribers.
+func (b *Broker) TryAddSubscriber(opts ...SubscriberOptions) (*Subscriber, error) {
+	return b.addSubscriber("", opts...)
+}
+
+// addSubscriber creates a subscriber with the given ID, or a unique ID when it
+// is empty, and adds it to the broker.
+func (b *Broker) addSubscriber(id string, opts ...SubscriberOptions) (*Subscriber, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
+	if b.closed.Load() {
+		return nil, ErrBrokerClosed
+	}
 	if b.opt.MaxSubscribers != 0 && len(b.subscribers)+1 > b.opt.MaxSubscribers {
-		return nil
+		return nil, ErrMaxSubscribers
 	}
 
-	id, s := NewSubscriber()
-	b.subscribers[id] = s
-	return s
+	if _, ok := b.subscribers[id]; ok {
+		return nil, ErrDurableInUse
+	}
+
+	s, err := TryNewSubscriber(b.subscriberOptions(opts...))
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		s.ID = id
+	}
+	s.onDisconnect = b.RemoveSubscriber
+	b.subscribers[s.ID] = s
+	return s, nil
+}
+
+// subscriberOptions merges the given subscriber options with the defaults of
+// the broker. The drop handler always counts the drop on the broker before
+// calling the handlers of the subscriber and the broker. A dropped message
+// tracked for acknowledgement stays tracked, so its ack deadline redelivers
+// or dead-letters it.
+func (b *Broker) subscriberOptions(opts ...SubscriberOptions) SubscriberOptions {
+	var opt SubscriberOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.BufferSize <= 0 {
+		opt.BufferSize = b.opt.BufferSize
+	}
+	if opt.Overflow == 0 {
+		opt.Overflow = b.opt.Overflow
+	}
+	if opt.BlockTimeout == 0 {
+		opt.BlockTimeout = b.opt.BlockTimeout
+	}
+	if opt.BlockTimeout == 0 && b.opt.AtLeastOnce {
+		opt.BlockTimeout = -1
+	}
+	if b.opt.Delivery == DeliveryOrdered {
+		opt.Ordered = true
+	}
+	if opt.DeadLetter == nil {
+		opt.DeadLetter = b.opt.DeadLetter
+	}
+
+	onDrop := opt.OnDrop
+	opt.OnDrop = func(s *Subscriber, msg *Message, policy OverflowPolicy) {
+		b.dropped.Add(1)
+		if msg.delivery == nil {
+			msg.discard()
+		} else {
+			msg.delivery.start(msg)
+		}
+		if onDrop != nil {
+			onDrop(s, msg, policy)
+		}
+		if b.opt.OnDrop != nil {
+			b.opt.OnDrop(s, msg, policy)
+		}
+	}
+
+	return opt
+}
+
+// Dropped returns the number of messages dropped by all subscribers of the
+// broker because their buffers were full.
+func (b *Broker) Dropped() uint64 {
+	return b.dropped.Load()
 }
 
 // Subscribe adds the subscriber to the specified topic.
 //
 // The subscriber is added to the list of subscribers for the specified topic.
 // When a message is published to the topic, the subscriber will receive the
-// message.
+// message. The retained messages of the topic, or of every topic matching it
+// when wildcards are enabled, are delivered to the subscriber right away.
 //
-// The subscriber is not added if it is already subscribed to the topic.
+// The subscriber is not added if it is already subscribed to the topic, or
+// if TrySubscribe would return an error.
 func (b *Broker) Subscribe(s *Subscriber, topic string) {
+	_ = b.TrySubscribe(s, topic)
+}
+
+// TrySubscribe adds the subscriber to the specified topic.
+//
+// It returns ErrBrokerClosed when the broker is shut down,
+// ErrSubscriberInactive when the subscriber has been removed and
+// ErrInvalidTopic when the topic is empty or, with wildcards enabled, has an
+// empty segment.
+func (b *Broker) TrySubscribe(s *Subscriber, topic string) error {
+	if err := b.checkSubscription(s, topic); err != nil {
+		return err
+	}
+
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if !b.indexed(topic) && b.trie != nil {
+		b.trie.insert(topic)
+	}
+	added := b.subscribe(s, topic)
+	b.mutex.Unlock()
 
+	if added && s.durable != nil {
+		s.durable.addTopic(s, topic)
+		if b.journal != nil {
+			b.journal.saveCheckpoints()
+		}
+	}
+	if added {
+		b.deliverRetained(s, b.topicMatcher(topic))
+	}
+	return nil
+}
+
+// checkSubscription returns why the subscriber cannot subscribe to the topic.
+func (b *Broker) checkSubscription(s *Subscriber, topic string) error {
+	if err := b.checkSubscriber(s); err != nil {
+		return err
+	}
+	return b.checkTopic(topic, false)
+}
+
+// checkSubscriber returns why the subscriber cannot subscribe to any topic.
+func (b *Broker) checkSubscriber(s *Subscriber) error {
+	if b.closed.Load() {
+		return ErrBrokerClosed
+	}
+	if !s.IsActive() {
+		return ErrSubscriberInactive
+	}
+	return nil
+}
+
+// checkTopic returns an error when the topic is empty or, with wildcards
+// enabled, has an empty segment. Published topics cannot contain wildcards.
+func (b *Broker) checkTopic(topic string, publish bool) error {
+	if topic == "" {
+		return fmt.Errorf("%w: empty topic", ErrInvalidTopic)
+	}
+	if !b.opt.Wildcard {
+		return nil
+	}
+
+	for _, segment := range strings.Split(topic, b.opt.Delimiter) {
+		if segment == "" {
+			return fmt.Errorf("%w: empty segment in %q", ErrInvalidTopic, topic)
+		}
+		if publish && (segment == SingleWildcard || segment == MultiWildcard || segment == GlobWildcard) {
+			return fmt.Errorf("%w: wildcard in published topic %q", ErrInvalidTopic, topic)
+		}
+	}
+	return nil
+}
+
+// indexed reports whether any subscriber or group is subscribed to the given
+// topic. The caller must hold the mutex.
+func (b *Broker) indexed(topic string) bool {
+	return len(b.topics[topic]) > 0 || len(b.groups[topic]) > 0
+}
+
+// unindex forgets the given topic once nobody is subscribed to it anymore.
+// The caller must hold the mutex.
+func (b *Broker) unindex(topic string) {
+	if _, ok := b.matchers[topic]; ok {
+		delete(b.matchers, topic)
+		b.resetMatchCache()
+	} else if b.trie != nil {
+		b.trie.remove(topic)
+	}
+}
+
+// subscribe registers the subscriber under the given topic or pattern key.
+// The caller must hold the mutex.
+func (b *Broker) subscribe(s *Subscriber, topic string) bool {
 	if b.topics[topic] == nil {
 		b.topics[topic] = Subscribers{}
 	}
+	if _, ok := b.topics[topic][s.ID]; ok {
+		return false
+	}
 
+	b.leaveGroup(s, topic)
 	s.AddTopic(topic)
 	b.topics[topic][s.ID] = s
+	return true
 }
 
 // Unsubscribe removes the subscriber from the specified topic.
@@ -89,11 +395,34 @@ func (b *Broker) Subscribe(s *Subscriber, topic string) {
 // The subscriber is not removed if it is not currently subscribed to the
 // topic.
 func (b *Broker) Unsubscribe(s *Subscriber, topic string) {
+	_ = b.TryUnsubscribe(s, topic)
+}
+
+// TryUnsubscribe removes the subscriber from the specified topic, or returns
+// ErrNotSubscribed when the subscriber is not subscribed to it.
+func (b *Broker) TryUnsubscribe(s *Subscriber, topic string) error {
+	if !s.isSubscribed(topic) {
+		return ErrNotSubscribed
+	}
+
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	delete(b.topics[topic], s.ID)
+	if subscribers, ok := b.topics[topic]; ok {
+		delete(subscribers, s.ID)
+		if len(subscribers) == 0 {
+			delete(b.topics, topic)
+		}
+	}
+	b.leaveGroup(s, topic)
+	if !b.indexed(topic) {
+		b.unindex(topic)
+	}
 	s.RemoveTopic(topic)
+	if s.durable != nil {
+		s.durable.removeTopic(s, topic)
+	}
+	return nil
 }
 
 // RemoveSubscriber removes the subscriber from all topics and the broker.
@@ -103,9 +432,13 @@ func (b *Broker) Unsubscribe(s *Subscriber, topic string) {
 // receive the message.
 //
 // The subscriber is then removed from the broker and the resources associated
-// with the subscriber are released.
+// with the subscriber are released. The durable subscription of a durable
+// subscriber is remembered, see AddDurableSubscriber.
 func (b *Broker) RemoveSubscriber(s *Subscriber) {
-	for topic := range s.topics {
+	if s.durable != nil {
+		b.disconnect(s)
+	}
+	for _, topic := range s.GetTopic() {
 		b.Unsubscribe(s, topic)
 	}
 
@@ -119,12 +452,17 @@ func (b *Broker) RemoveSubscriber(s *Subscriber) {
 // GetSubscribers returns the number of subscribers for the given topic.
 //
 // The number of subscribers includes only active subscribers. Inactive
-// subscribers are not counted.
+// subscribers are not counted. Members of consumer groups subscribed to the
+// topic are counted as well.
 func (b *Broker) GetSubscribers(topic string) int {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	return len(b.topics[topic])
+	count := len(b.topics[topic])
+	for _, g := range b.groups[topic] {
+		count += len(g.members)
+	}
+	return count
 }
 
 // Broadcast sends the given message to all subscribers in all topics.
@@ -133,46 +471,112 @@ func (b *Broker) GetSubscribers(topic string) int {
 //
 // The message is sent to the subscribers asynchronously.
 func (b *Broker) Broadcast(msg any) {
+	if b.closed.Load() {
+		return
+	}
+
+	// The subscribers are signalled once the lock is released, as signalling
+	// may block or remove a subscriber.
+	type recipient struct {
+		s *Subscriber
+		m *Message
+	}
+	var recipients []recipient
+
+	b.mutex.RLock()
 	for topic := range b.topics {
+		m, err := b.newPublished(topic, msg)
+		if err != nil {
+			break
+		}
 		for _, s := range b.topics[topic] {
-			m := NewMessage(topic, msg)
-			go (func(s *Subscriber) {
-				s.Signal(m)
-			})(s)
+			recipients = append(recipients, recipient{s, m.clone()})
 		}
 	}
+	b.mutex.RUnlock()
+
+	for _, r := range recipients {
+		b.signal(r.s, r.m)
+	}
+}
+
+// signal hands the message to the subscriber according to the delivery mode
+// of the broker. Ordered subscribers queue the message before signal returns,
+// so consecutive calls keep their order.
+func (b *Broker) signal(s *Subscriber, m *Message) {
+	if b.opt.AtLeastOnce {
+		b.track(s, m)
+	}
+	if b.opt.Delivery == DeliveryConcurrent {
+		s.signalAsync(m)
+		return
+	}
+	s.Signal(m)
 }
 
 // Publish sends the given message to all subscribers of the specified topic.
 //
 // The message is delivered to all active subscribers of the specified topic.
+// When wildcards are enabled, it is also delivered to the subscribers of every
+// wildcard topic matching it, such as `orders.*.created` or `orders.#`, and
+// to the subscribers of every matching pattern or predicate. A subscriber
+// matching through several topics receives the message once. Each consumer
+// group subscribed to a matching topic receives the message on one member.
 // The message is sent to the subscribers asynchronously. If a subscriber is
-// inactive, it will not receive the message.
+// inactive, it will not receive the message. Each subscriber buffers the
+// message and applies its overflow policy when the buffer is full, so a slow
+// subscriber does not hold on to goroutines of the publisher. Nothing is
+// published once the broker is shut down.
+//
+// With DeliveryOrdered, the message is queued for every subscriber before
+// Publish returns, so messages published one after another reach each
+// subscriber in the same order.
 func (b *Broker) Publish(topic string, msg any) {
-	b.mutex.RLock()
+	_ = b.TryPublish(topic, msg)
+}
+
+// TryPublish sends the given message to all subscribers of the specified
+// topic, like Publish.
+//
+// It returns ErrBrokerClosed when the broker is shut down and ErrInvalidTopic
+// when the topic is empty or, with wildcards enabled, has an empty or wildcard
+// segment. Use PublishWithOptions to set the metadata of the message.
+func (b *Broker) TryPublish(topic string, msg any) error {
+	_, err := b.PublishWithOptions(topic, msg)
+	return err
+}
+
+// recipients returns the subscribers that receive the given message. Every
+// consumer group subscribed to a matching topic contributes the member picked
+// by its balancer. The caller must hold the mutex.
+func (b *Broker) recipients(m *Message) ([]*Subscriber, map[string]*group) {
+	topic := m.GetTopic()
 	topics := []string{topic}
-	if b.opt.Wildcard {
-		patterns := strings.Split(topic, b.opt.Delimiter)
-		for i := 0; i < len(patterns)-1; i++ {
-			topics = append(topics, fmt.Sprintf("%s%s*", patterns[i], b.opt.Delimiter))
-		}
+	if b.trie != nil {
+		topics = b.trie.match(topic)
 	}
+	topics = append(topics, b.matchPatterns(topic)...)
+
+	seen := map[string]bool{}
+	groups := map[string]*group{}
 	var subscribers []*Subscriber
+	add := func(s *Subscriber) bool {
+		if s == nil || seen[s.ID] {
+			return false
+		}
+		seen[s.ID] = true
+		subscribers = append(subscribers, s)
+		return true
+	}
 	for _, tp := range topics {
 		for _, subscriber := range b.topics[tp] {
-			subscribers = append(subscribers, subscriber)
+			add(subscriber)
 		}
-	}
-	b.mutex.RUnlock()
-
-	for _, s := range subscribers {
-		m := NewMessage(topic, msg)
-		if !s.active {
-			return
+		for _, g := range b.groups[tp] {
+			if member := g.balancer.Pick(m); add(member) {
+				groups[member.ID] = g
+			}
 		}
-
-		go (func(s *Subscriber) {
-			s.Signal(m)
-		})(s)
 	}
+	return subscribers, groups
 }
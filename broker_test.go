@@ -3,6 +3,7 @@ package pubsub_test
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/tinh-tinh/pubsub/v2"
@@ -89,3 +90,200 @@ func Test_Pattern(t *testing.T) {
 		broker.Publish("orders.created", "hello")
 	})()
 }
+
+func Test_Overflow(t *testing.T) {
+	t.Run("drop newest", func(t *testing.T) {
+		var dropped []any
+		broker := pubsub.NewBroker(pubsub.BrokerOptions{
+			BufferSize: 2,
+			Overflow:   pubsub.OverflowDropNewest,
+			Delivery:   pubsub.DeliveryConcurrent,
+			OnDrop: func(s *pubsub.Subscriber, msg *pubsub.Message, policy pubsub.OverflowPolicy) {
+				dropped = append(dropped, msg.GetContent())
+			},
+		})
+		sub := broker.AddSubscriber()
+		for i := range 4 {
+			sub.Signal(pubsub.NewMessage("topic", i))
+		}
+
+		require.Equal(t, 0, (<-sub.GetMessages()).GetContent())
+		require.Equal(t, 1, (<-sub.GetMessages()).GetContent())
+		require.Equal(t, []any{2, 3}, dropped)
+		require.Equal(t, uint64(2), sub.Dropped())
+		require.Equal(t, uint64(2), broker.Dropped())
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		broker := pubsub.NewBroker(pubsub.BrokerOptions{
+			BufferSize: 2,
+			Overflow:   pubsub.OverflowDropOldest,
+			Delivery:   pubsub.DeliveryConcurrent,
+		})
+		sub := broker.AddSubscriber()
+		for i := range 4 {
+			sub.Signal(pubsub.NewMessage("topic", i))
+		}
+
+		require.Equal(t, 2, (<-sub.GetMessages()).GetContent())
+		require.Equal(t, 3, (<-sub.GetMessages()).GetContent())
+		require.Equal(t, uint64(2), broker.Dropped())
+	})
+
+	t.Run("block with timeout", func(t *testing.T) {
+		broker := pubsub.NewBroker(pubsub.BrokerOptions{
+			BufferSize:   1,
+			BlockTimeout: 10 * time.Millisecond,
+			Delivery:     pubsub.DeliveryConcurrent,
+		})
+		sub := broker.AddSubscriber()
+		sub.Signal(pubsub.NewMessage("topic", 1))
+
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			<-sub.GetMessages()
+		}()
+		sub.Signal(pubsub.NewMessage("topic", 2))
+		require.Equal(t, uint64(0), sub.Dropped())
+
+		sub.Signal(pubsub.NewMessage("topic", 3))
+		require.Equal(t, uint64(1), sub.Dropped())
+	})
+
+	t.Run("block with default timeout", func(t *testing.T) {
+		broker := pubsub.NewBroker(pubsub.BrokerOptions{BufferSize: 2})
+		sub := broker.AddSubscriber()
+		broker.Subscribe(sub, "topic")
+
+		// Nobody reads, yet publishing is only held up by the timeout.
+		start := time.Now()
+		for i := range 4 {
+			broker.Publish("topic", i)
+		}
+		require.Less(t, time.Since(start), time.Second)
+		require.Equal(t, uint64(1), sub.Dropped())
+	})
+
+	t.Run("remove blocked subscriber", func(t *testing.T) {
+		broker := pubsub.NewBroker(pubsub.BrokerOptions{
+			BufferSize:   1,
+			BlockTimeout: -1,
+			Delivery:     pubsub.DeliveryConcurrent,
+		})
+		sub := broker.AddSubscriber()
+		broker.Subscribe(sub, "topic")
+		for i := range 3 {
+			broker.Publish("topic", i)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		removed := make(chan struct{})
+		go func() {
+			broker.RemoveSubscriber(sub)
+			close(removed)
+		}()
+		select {
+		case <-removed:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("RemoveSubscriber blocked by a waiting publisher")
+		}
+		require.False(t, sub.IsActive())
+		require.Equal(t, 0, broker.GetSubscribers("topic"))
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		broker := pubsub.NewBroker(pubsub.BrokerOptions{
+			Delivery: pubsub.DeliveryConcurrent,
+		})
+		sub := broker.AddSubscriber(pubsub.SubscriberOptions{
+			BufferSize: 1,
+			Overflow:   pubsub.OverflowDisconnect,
+		})
+		broker.Subscribe(sub, "topic")
+		sub.Signal(pubsub.NewMessage("topic", 1))
+		sub.Signal(pubsub.NewMessage("topic", 2))
+
+		require.False(t, sub.IsActive())
+		require.Equal(t, 0, broker.GetSubscribers("topic"))
+		require.Equal(t, uint64(1), broker.Dropped())
+	})
+
+	t.Run("disconnect on broadcast", func(t *testing.T) {
+		broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+		sub := broker.AddSubscriber(pubsub.SubscriberOptions{
+			BufferSize: 1,
+			Overflow:   pubsub.OverflowDisconnect,
+		})
+		broker.Subscribe(sub, "topic")
+		for range 5 {
+			broker.Broadcast("hello")
+		}
+
+		require.False(t, sub.IsActive())
+		require.Equal(t, 0, broker.GetSubscribers("topic"))
+	})
+}
+
+func Test_OrderedDelivery(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "prices")
+
+	for i := range 100 {
+		broker.Publish("prices", i)
+	}
+	for i := range 100 {
+		msg := <-sub.GetMessages()
+		require.Equal(t, i, msg.GetContent())
+	}
+	require.Eventually(t, func() bool {
+		return sub.Pending() == 0
+	}, time.Second, time.Millisecond)
+
+	broker.RemoveSubscriber(sub)
+	_, ok := <-sub.GetMessages()
+	require.False(t, ok)
+}
+
+func Test_OrderedOverflow(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		BufferSize: 2,
+		Overflow:   pubsub.OverflowDropOldest,
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "prices")
+	for i := range 10 {
+		broker.Publish("prices", i)
+	}
+
+	// The dispatch loop holds at most one message besides the queue.
+	require.LessOrEqual(t, sub.Pending(), 3)
+	require.GreaterOrEqual(t, broker.Dropped(), uint64(7))
+
+	last := -1
+	for range 10 - int(broker.Dropped()) {
+		msg := <-sub.GetMessages()
+		require.Greater(t, msg.GetContent(), last)
+		last = msg.GetContent().(int)
+	}
+	require.Equal(t, 9, last)
+}
+
+// drain returns the contents of the messages the subscriber receives until
+// no message arrives for a short while.
+func drain(sub *pubsub.Subscriber) []any {
+	var contents []any
+	for {
+		select {
+		case msg, ok := <-sub.GetMessages():
+			if !ok {
+				return contents
+			}
+			contents = append(contents, msg.GetContent())
+		case <-time.After(20 * time.Millisecond):
+			return contents
+		}
+	}
+}
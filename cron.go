@@ -0,0 +1,600 @@
+package pubsub
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CronExpr is a parsed cron expression, see ParseCron.
+type CronExpr struct {
+	expr     string
+	second   uint64
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	anyDay   bool          // Day of month or day of week is a wildcard
+	every    time.Duration // Interval of an @every expression
+	location *time.Location
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	secondField = cronField{name: "second", min: 0, max: 59}
+	minuteField = cronField{name: "minute", min: 0, max: 59}
+	hourField   = cronField{name: "hour", min: 0, max: 23}
+	domField    = cronField{name: "day of month", min: 1, max: 31}
+	monthField  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// ParseCron parses a cron expression in the given time zone, time.Local when
+// none is given.
+//
+// The expression has five fields, minute, hour, day of month, month and day
+// of week, or six with a leading second field. A field is a wildcard `*`, a
+// value, a range `1-5`, a step `*/15` or `10-50/10`, or a comma separated
+// list of those. Months and days of week accept their three-letter English
+// names, and Sunday is 0 or 7. When both the day of month and the day of week
+// are restricted, a day matching either runs. `?` is a wildcard for the day
+// fields.
+//
+// The descriptors @yearly, @monthly, @weekly, @daily, @hourly and
+// `@every <duration>` are accepted too. A `CRON_TZ=<zone>` prefix sets the
+// time zone of the expression, overriding the given one.
+func ParseCron(expr string, location ...*time.Location) (*CronExpr, error) {
+	c := &CronExpr{expr: expr, location: time.Local}
+	if len(location) > 0 && location[0] != nil {
+		c.location = location[0]
+	}
+
+	spec := strings.TrimSpace(expr)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		zone, rest, _ := strings.Cut(spec, " ")
+		_, name, _ := strings.Cut(zone, "=")
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCron, err)
+		}
+		c.location = loc
+		spec = strings.TrimSpace(rest)
+	}
+
+	if strings.HasPrefix(spec, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("%w: invalid interval in %q", ErrInvalidCron, expr)
+		}
+		c.every = every
+		return c, nil
+	}
+	if descriptor, ok := cronDescriptors[spec]; ok {
+		spec = descriptor
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("%w: %q has %d fields, want 5 or 6", ErrInvalidCron, expr, len(fields))
+	}
+
+	var err error
+	parsers := []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&c.second, secondField},
+		{&c.minute, minuteField},
+		{&c.hour, hourField},
+		{&c.dom, domField},
+		{&c.month, monthField},
+		{&c.dow, dowField},
+	}
+	for i, parser := range parsers {
+		if *parser.bits, err = parser.field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("%w: %v in %q", ErrInvalidCron, err, expr)
+		}
+	}
+	// Sunday is both 0 and 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDay = isWildcard(fields[3]) || isWildcard(fields[5])
+	return c, nil
+}
+
+func isWildcard(field string) bool {
+	return field == "*" || field == "?"
+}
+
+// parse returns the values of the field as a bit set.
+func (f cronField) parse(field string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		expr, step, hasStep := strings.Cut(part, "/")
+		every := 1
+		if hasStep {
+			n, err := strconv.Atoi(step)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s", step, f.name)
+			}
+			every = n
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case isWildcard(expr):
+		case strings.Contains(expr, "-"):
+			from, to, _ := strings.Cut(expr, "-")
+			var err error
+			if low, err = f.value(from); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(to); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q in %s", expr, f.name)
+			}
+		default:
+			value, err := f.value(expr)
+			if err != nil {
+				return 0, err
+			}
+			low = value
+			if !hasStep {
+				high = value
+			}
+		}
+
+		for v := low; v <= high; v += every {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// value parses a value of the field, a number or a name.
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q", f.name, s)
+	}
+	return v, nil
+}
+
+// String returns the expression as given to ParseCron.
+func (c *CronExpr) String() string {
+	return c.expr
+}
+
+// Location returns the time zone of the expression.
+func (c *CronExpr) Location() *time.Location {
+	return c.location
+}
+
+// Next returns the first time matching the expression after the given time,
+// in the time zone of the given time. It returns the zero time when nothing
+// matches within five years, such as on February 30th.
+func (c *CronExpr) Next(after time.Time) time.Time {
+	if c.every > 0 {
+		return after.Add(c.every).Truncate(time.Second)
+	}
+
+	t := after.In(c.location).Truncate(time.Second).Add(time.Second)
+	limit := t.Year() + 5
+
+wrap:
+	if t.Year() > limit {
+		return time.Time{}
+	}
+	for c.month&(1<<uint(t.Month())) == 0 {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+	for !c.matchDay(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+	for c.hour&(1<<uint(t.Hour())) == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+	for c.minute&(1<<uint(t.Minute())) == 0 {
+		t = t.Truncate(time.Minute).Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+	for c.second&(1<<uint(t.Second())) == 0 {
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto wrap
+		}
+	}
+	return t.In(after.Location())
+}
+
+// matchDay reports whether the day of t matches the day of month and day of
+// week fields.
+func (c *CronExpr) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// OverlapPolicy decides what a schedule does when a run is due while the
+// previous one is still running.
+type OverlapPolicy int
+
+const (
+	// OverlapSkip skips the run. This is the default.
+	OverlapSkip OverlapPolicy = iota + 1
+	// OverlapAllow starts the run alongside the previous one.
+	OverlapAllow
+	// OverlapQueue starts the run once the previous one completes. Runs due
+	// meanwhile are merged into one.
+	OverlapQueue
+)
+
+// PayloadFactory returns the payload published by a schedule for the run due
+// at the given time.
+type PayloadFactory func(at time.Time) any
+
+type CronOptions struct {
+	// identifies the schedule, defaults to a generated ID
+	ID string
+	// the time zone of the expression, unless it has a CRON_TZ prefix,
+	// defaults to time.Local
+	Location *time.Location
+	// delays each run by a random duration up to Jitter, to spread the load
+	// of schedules due at the same time
+	Jitter time.Duration
+	// what happens when a run is due while the previous one is running,
+	// defaults to OverlapSkip
+	Overlap OverlapPolicy
+	// options of the published messages
+	Publish []PublishOption
+}
+
+// CronJob declares a schedule registered by ForSchedule.
+type CronJob struct {
+	Expr    string
+	Topic   string
+	Payload PayloadFactory
+	Options CronOptions
+}
+
+// ScheduleInfo describes a schedule added with Schedule.
+type ScheduleInfo struct {
+	ID      string
+	Expr    string
+	Topic   string
+	Next    time.Time // Zero while the schedule is paused
+	Paused  bool
+	Runs    int // Runs that published a message
+	Skipped int // Runs skipped by the overlap policy
+}
+
+type cronJob struct {
+	id      string
+	expr    *CronExpr
+	topic   string
+	payload PayloadFactory
+	opt     CronOptions
+	broker  *Broker
+	mutex   sync.Mutex
+	next    time.Time
+	paused  bool
+	running int
+	queued  bool
+	runs    int
+	skipped int
+	changed chan struct{}
+	done    chan struct{}
+}
+
+// Schedule publishes a message to the topic at every time matching the cron
+// expression, and returns the ID of the schedule. The payload of each message
+// is returned by the factory. See ParseCron for the syntax of the expression,
+// for instance `*/5 * * * *` runs every five minutes and `0 30 9 * * mon-fri`
+// at 9:30:00 on weekdays.
+//
+// Each schedule runs on its own goroutine. The factory is called and the
+// message published on another goroutine, so a slow run does not delay the
+// next one; the overlap policy of the options decides whether runs may
+// overlap. Runs missed while the broker is busy are not caught up. The
+// schedules stop when the broker shuts down.
+//
+// It returns ErrInvalidCron for an invalid expression, ErrInvalidTopic for an
+// invalid topic, ErrScheduleExists when a schedule with the same ID exists,
+// and ErrBrokerClosed when the broker is shut down.
+func (b *Broker) Schedule(expr string, topic string, payload PayloadFactory, opts ...CronOptions) (string, error) {
+	var opt CronOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Overlap == 0 {
+		opt.Overlap = OverlapSkip
+	}
+	if b.closed.Load() {
+		return "", ErrBrokerClosed
+	}
+	if err := b.checkTopic(topic, true); err != nil {
+		return "", err
+	}
+	cron, err := ParseCron(expr, opt.Location)
+	if err != nil {
+		return "", err
+	}
+	if opt.ID == "" {
+		if opt.ID, err = newID(); err != nil {
+			return "", err
+		}
+	}
+
+	j := &cronJob{
+		id:      opt.ID,
+		expr:    cron,
+		topic:   topic,
+		payload: payload,
+		opt:     opt,
+		broker:  b,
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.crons[j.id]; ok {
+		return "", ErrScheduleExists
+	}
+	b.crons[j.id] = j
+	go j.run()
+	return j.id, nil
+}
+
+// PauseSchedule stops the runs of the schedule until ResumeSchedule is
+// called. It reports false when no schedule has the given ID.
+func (b *Broker) PauseSchedule(id string) bool {
+	return b.setPaused(id, true)
+}
+
+// ResumeSchedule resumes a paused schedule from the next time matching its
+// expression. It reports false when no schedule has the given ID.
+func (b *Broker) ResumeSchedule(id string) bool {
+	return b.setPaused(id, false)
+}
+
+// RemoveSchedule stops and removes the schedule. A run in progress completes.
+// It reports false when no schedule has the given ID.
+func (b *Broker) RemoveSchedule(id string) bool {
+	b.mutex.Lock()
+	j, ok := b.crons[id]
+	delete(b.crons, id)
+	b.mutex.Unlock()
+
+	if ok {
+		close(j.done)
+	}
+	return ok
+}
+
+// GetSchedule returns the state of the schedule with the given ID.
+func (b *Broker) GetSchedule(id string) (ScheduleInfo, bool) {
+	b.mutex.RLock()
+	j, ok := b.crons[id]
+	b.mutex.RUnlock()
+
+	if !ok {
+		return ScheduleInfo{}, false
+	}
+	return j.info(), true
+}
+
+// Schedules returns the state of every schedule, sorted by ID.
+func (b *Broker) Schedules() []ScheduleInfo {
+	b.mutex.RLock()
+	schedules := make([]ScheduleInfo, 0, len(b.crons))
+	for _, j := range b.crons {
+		schedules = append(schedules, j.info())
+	}
+	b.mutex.RUnlock()
+
+	slices.SortFunc(schedules, func(x, y ScheduleInfo) int {
+		return cmp.Compare(x.ID, y.ID)
+	})
+	return schedules
+}
+
+// setPaused pauses or resumes the schedule with the given ID.
+func (b *Broker) setPaused(id string, paused bool) bool {
+	b.mutex.RLock()
+	j, ok := b.crons[id]
+	b.mutex.RUnlock()
+
+	if !ok {
+		return false
+	}
+	j.mutex.Lock()
+	j.paused = paused
+	if paused {
+		j.next = time.Time{}
+	}
+	j.mutex.Unlock()
+
+	select {
+	case j.changed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// stopSchedules removes every schedule.
+func (b *Broker) stopSchedules() {
+	b.mutex.Lock()
+	crons := b.crons
+	b.crons = map[string]*cronJob{}
+	b.mutex.Unlock()
+
+	for _, j := range crons {
+		close(j.done)
+	}
+}
+
+// run starts the runs of the schedule when they are due, until it is
+// removed.
+func (j *cronJob) run() {
+	after := time.Now()
+	for {
+		j.mutex.Lock()
+		j.next = time.Time{}
+		if !j.paused {
+			j.next = j.expr.Next(after)
+		}
+		next := j.next
+		j.mutex.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			wait := time.Until(next)
+			if j.opt.Jitter > 0 {
+				wait += rand.N(j.opt.Jitter)
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-timeout:
+			j.start(next)
+			after = next
+			if now := time.Now(); now.After(after) {
+				after = now
+			}
+		case <-j.changed:
+			after = time.Now()
+		case <-j.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-j.done:
+			return
+		default:
+		}
+	}
+}
+
+// start starts the run due at the given time, unless the overlap policy
+// prevents it.
+func (j *cronJob) start(at time.Time) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.running > 0 {
+		switch j.opt.Overlap {
+		case OverlapSkip:
+			j.skipped++
+			return
+		case OverlapQueue:
+			j.queued = true
+			return
+		}
+	}
+	j.running++
+	go j.publish(at)
+}
+
+// publish publishes the message of the run due at the given time.
+func (j *cronJob) publish(at time.Time) {
+	defer func() {
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+
+		j.running--
+		if j.queued && j.running == 0 {
+			j.queued = false
+			j.running++
+			go j.publish(time.Now())
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("pubsub: schedule %s: panic: %v\n", j.id, r)
+		}
+	}()
+
+	payload := j.payload(at)
+	if _, err := j.broker.PublishWithOptions(j.topic, payload, j.opt.Publish...); err != nil {
+		log.Printf("pubsub: schedule %s: %v\n", j.id, err)
+		return
+	}
+
+	j.mutex.Lock()
+	j.runs++
+	j.mutex.Unlock()
+}
+
+// info returns the state of the schedule.
+func (j *cronJob) info() ScheduleInfo {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return ScheduleInfo{
+		ID:      j.id,
+		Expr:    j.expr.String(),
+		Topic:   j.topic,
+		Next:    j.next,
+		Paused:  j.paused,
+		Runs:    j.runs,
+		Skipped: j.skipped,
+	}
+}
@@ -0,0 +1,157 @@
+package pubsub_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+func Test_ParseCron(t *testing.T) {
+	from := time.Date(2024, time.March, 15, 10, 7, 30, 0, time.UTC) // A Friday
+
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"*/5 * * * *", time.Date(2024, time.March, 15, 10, 10, 0, 0, time.UTC)},
+		{"* * * * * *", time.Date(2024, time.March, 15, 10, 7, 31, 0, time.UTC)},
+		{"15,45 * * * * *", time.Date(2024, time.March, 15, 10, 7, 45, 0, time.UTC)},
+		{"0 30 9 * * mon-fri", time.Date(2024, time.March, 18, 9, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * feb,jun *", time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 7", time.Date(2024, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		{"10-20/5 8 * * *", time.Date(2024, time.March, 16, 8, 10, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.March, 15, 11, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2024, time.March, 15, 10, 9, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		cron, err := pubsub.ParseCron(c.expr, time.UTC)
+		require.Nil(t, err, c.expr)
+		require.Equal(t, c.next, cron.Next(from), c.expr)
+	}
+
+	// The day of month or the day of week matches when both are restricted.
+	cron, err := pubsub.ParseCron("0 0 20 * sat", time.UTC)
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC), cron.Next(from))
+
+	never, err := pubsub.ParseCron("0 0 30 2 *", time.UTC)
+	require.Nil(t, err)
+	require.True(t, never.Next(from).IsZero())
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@every 1ms", "CRON_TZ=Mars/Base * * * * *"} {
+		_, err := pubsub.ParseCron(expr)
+		require.ErrorIs(t, err, pubsub.ErrInvalidCron, expr)
+	}
+}
+
+func Test_ParseCronTimezone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	require.Nil(t, err)
+	from := time.Date(2024, time.March, 15, 10, 0, 0, 0, time.UTC)
+
+	cron, err := pubsub.ParseCron("CRON_TZ=Asia/Tokyo 0 9 * * *")
+	require.Nil(t, err)
+	require.Equal(t, tokyo, cron.Location())
+	require.Equal(t, time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC), cron.Next(from))
+
+	cron, err = pubsub.ParseCron("0 9 * * *", tokyo)
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC), cron.Next(from))
+}
+
+func Test_Schedule(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "ticks")
+
+	id, err := broker.Schedule("* * * * * *", "ticks", func(at time.Time) any {
+		return at.Second()
+	}, pubsub.CronOptions{ID: "tick", Publish: []pubsub.PublishOption{pubsub.WithPublisher("cron")}})
+	require.Nil(t, err)
+	require.Equal(t, "tick", id)
+
+	_, err = broker.Schedule("* * * * * *", "ticks", nil, pubsub.CronOptions{ID: "tick"})
+	require.ErrorIs(t, err, pubsub.ErrScheduleExists)
+	_, err = broker.Schedule("every minute", "ticks", nil)
+	require.ErrorIs(t, err, pubsub.ErrInvalidCron)
+
+	msg := <-sub.GetMessages()
+	require.Equal(t, msg.GetPublishedAt().Second(), msg.GetContent())
+	require.Equal(t, "cron", msg.GetPublisher())
+
+	require.True(t, broker.PauseSchedule("tick"))
+	info, ok := broker.GetSchedule("tick")
+	require.True(t, ok)
+	require.True(t, info.Paused)
+	require.True(t, info.Next.IsZero())
+	drain(sub)
+	time.Sleep(1100 * time.Millisecond)
+	require.Empty(t, drain(sub))
+
+	require.True(t, broker.ResumeSchedule("tick"))
+	<-sub.GetMessages()
+	info, _ = broker.GetSchedule("tick")
+	require.False(t, info.Paused)
+	require.False(t, info.Next.IsZero())
+	require.Eventually(t, func() bool {
+		info, _ := broker.GetSchedule("tick")
+		return info.Runs >= 2
+	}, time.Second, 5*time.Millisecond)
+	require.Len(t, broker.Schedules(), 1)
+	require.Equal(t, "tick", broker.Schedules()[0].ID)
+
+	require.True(t, broker.RemoveSchedule("tick"))
+	require.False(t, broker.RemoveSchedule("tick"))
+	require.False(t, broker.PauseSchedule("tick"))
+	drain(sub)
+	time.Sleep(1100 * time.Millisecond)
+	require.Empty(t, drain(sub))
+}
+
+func Test_ScheduleOverlap(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	release := make(chan struct{})
+	var runs atomic.Int32
+
+	_, err := broker.Schedule("* * * * * *", "ticks", func(at time.Time) any {
+		runs.Add(1)
+		<-release
+		return nil
+	}, pubsub.CronOptions{ID: "slow", Jitter: 10 * time.Millisecond})
+	require.Nil(t, err)
+
+	require.Eventually(t, func() bool {
+		info, _ := broker.GetSchedule("slow")
+		return info.Skipped >= 1
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(1), runs.Load())
+	close(release)
+	require.True(t, broker.RemoveSchedule("slow"))
+}
+
+func Test_ForSchedule(t *testing.T) {
+	appModule := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{
+			pubsub.ForRoot(pubsub.BrokerOptions{}),
+			pubsub.ForSchedule(pubsub.CronJob{
+				Expr:    "@hourly",
+				Topic:   "reports",
+				Payload: func(at time.Time) any { return "report" },
+				Options: pubsub.CronOptions{ID: "reports"},
+			}),
+		},
+	})
+	broker := pubsub.InjectBroker(appModule)
+	require.Equal(t, []string{"reports"}, appModule.Ref(pubsub.SCHEDULES))
+
+	info, ok := broker.GetSchedule("reports")
+	require.True(t, ok)
+	require.Equal(t, "@hourly", info.Expr)
+	require.Equal(t, "reports", info.Topic)
+}
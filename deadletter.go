@@ -0,0 +1,162 @@
+package pubsub
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeadLetterSuffix is appended to the topic of a message to name its default
+// dead-letter topic.
+const DeadLetterSuffix = ".dlq"
+
+const (
+	// ReasonAckDeadline is the failure reason of a message that was not
+	// acknowledged before the ack deadline.
+	ReasonAckDeadline = "ack deadline exceeded"
+	// ReasonRejected is the failure reason of a message rejected with Nack.
+	ReasonRejected = "rejected"
+)
+
+type DeadLetterPolicy struct {
+	// the number of failed deliveries after which a message is dead-lettered,
+	// zero only dead-letters messages rejected without requeue
+	MaxDeliveries int
+	// returns the dead-letter topic of a topic, defaults to the topic
+	// followed by DeadLetterSuffix
+	Topic func(topic string) string
+}
+
+func (p *DeadLetterPolicy) topic(topic string) string {
+	if p.Topic != nil {
+		return p.Topic(topic)
+	}
+	return topic + DeadLetterSuffix
+}
+
+// DeadLetter is a message that failed too many times. It is published as the
+// content of a message to the dead-letter topic and kept by the broker until
+// it is replayed or purged.
+type DeadLetter struct {
+	ID           string
+	MessageID    string // ID the message was published with
+	Topic        string // Topic the message was published to
+	Content      interface{}
+	Headers      map[string]string
+	Reason       string // Why the last delivery failed
+	Attempts     int
+	SubscriberID string
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+	DeadAt       time.Time
+}
+
+type deadLetterStore struct {
+	mutex   sync.RWMutex
+	seq     uint64
+	letters []*DeadLetter
+}
+
+func newDeadLetterStore() *deadLetterStore {
+	return &deadLetterStore{}
+}
+
+func (d *deadLetterStore) add(letter *DeadLetter) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.seq++
+	letter.ID = strconv.FormatUint(d.seq, 10)
+	d.letters = append(d.letters, letter)
+}
+
+// deadLetter wraps the failed message, publishes it to the dead-letter topic
+// and keeps it for inspection. Without a dead-letter policy the message is
+// discarded.
+func (b *Broker) deadLetter(s *Subscriber, m *Message, reason string) {
+	defer m.ticket.release()
+
+	policy := s.opt.DeadLetter
+	if policy == nil {
+		return
+	}
+
+	letter := &DeadLetter{
+		MessageID:    m.id,
+		Topic:        m.topic,
+		Content:      m.content,
+		Headers:      m.GetHeaders(),
+		Reason:       reason,
+		Attempts:     m.attempts,
+		SubscriberID: s.ID,
+		FirstAttempt: m.firstDeliveredAt,
+		LastAttempt:  m.deliveredAt,
+		DeadAt:       time.Now(),
+	}
+	b.deadLetters.add(letter)
+	b.Publish(policy.topic(m.topic), letter)
+}
+
+// DeadLetters returns the dead-lettered messages of the given topic, oldest
+// first. An empty topic returns the dead-lettered messages of every topic.
+func (b *Broker) DeadLetters(topic string) []*DeadLetter {
+	b.deadLetters.mutex.RLock()
+	defer b.deadLetters.mutex.RUnlock()
+
+	letters := []*DeadLetter{}
+	for _, letter := range b.deadLetters.letters {
+		if topic == "" || letter.Topic == topic {
+			letters = append(letters, letter)
+		}
+	}
+	return letters
+}
+
+// GetDeadLetter returns the dead-lettered message with the given ID.
+func (b *Broker) GetDeadLetter(id string) (*DeadLetter, bool) {
+	b.deadLetters.mutex.RLock()
+	defer b.deadLetters.mutex.RUnlock()
+
+	for _, letter := range b.deadLetters.letters {
+		if letter.ID == id {
+			return letter, true
+		}
+	}
+	return nil, false
+}
+
+// ReplayDeadLetter publishes the dead-lettered message with the given ID to
+// its original topic again and forgets it. The new message keeps the headers
+// of the dead-lettered one and is caused by it. It reports false when no such
+// message exists.
+func (b *Broker) ReplayDeadLetter(id string) bool {
+	b.deadLetters.mutex.Lock()
+	i := slices.IndexFunc(b.deadLetters.letters, func(letter *DeadLetter) bool {
+		return letter.ID == id
+	})
+	if i < 0 {
+		b.deadLetters.mutex.Unlock()
+		return false
+	}
+	letter := b.deadLetters.letters[i]
+	b.deadLetters.letters = slices.Delete(b.deadLetters.letters, i, i+1)
+	b.deadLetters.mutex.Unlock()
+
+	_, _ = b.PublishWithOptions(letter.Topic, letter.Content,
+		WithHeaders(letter.Headers), WithCausationID(letter.MessageID))
+	return true
+}
+
+// PurgeDeadLetters forgets the dead-lettered messages of the given topic and
+// returns how many were removed. An empty topic purges every topic.
+func (b *Broker) PurgeDeadLetters(topic string) int {
+	b.deadLetters.mutex.Lock()
+	defer b.deadLetters.mutex.Unlock()
+
+	count := len(b.deadLetters.letters)
+	b.deadLetters.letters = slices.DeleteFunc(b.deadLetters.letters, func(letter *DeadLetter) bool {
+		return topic == "" || letter.Topic == topic
+	})
+	return count - len(b.deadLetters.letters)
+}
@@ -0,0 +1,94 @@
+package pubsub_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_DeadLetter(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		AtLeastOnce: true,
+		DeadLetter: &pubsub.DeadLetterPolicy{
+			MaxDeliveries: 3,
+		},
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "payments")
+	dlq := broker.AddSubscriber()
+	broker.Subscribe(dlq, "payments.dlq")
+
+	published, err := broker.PublishWithOptions("payments", "charge", pubsub.WithHeader("tenant", "acme"))
+	require.Nil(t, err)
+	for attempt := 1; attempt <= 3; attempt++ {
+		msg := <-sub.GetMessages()
+		require.Equal(t, attempt, msg.GetAttempts())
+		msg.Nack(true)
+	}
+
+	msg := <-dlq.GetMessages()
+	letter := msg.GetContent().(*pubsub.DeadLetter)
+	require.Equal(t, published.ID, letter.MessageID)
+	require.Equal(t, "payments", letter.Topic)
+	require.Equal(t, map[string]string{"tenant": "acme"}, letter.Headers)
+	require.Equal(t, "charge", letter.Content)
+	require.Equal(t, pubsub.ReasonRejected, letter.Reason)
+	require.Equal(t, 3, letter.Attempts)
+	require.Equal(t, sub.ID, letter.SubscriberID)
+	require.False(t, letter.FirstAttempt.After(letter.LastAttempt))
+	require.False(t, letter.LastAttempt.After(letter.DeadAt))
+	msg.Ack()
+
+	require.Len(t, broker.DeadLetters("payments"), 1)
+	require.Empty(t, broker.DeadLetters("orders"))
+	found, ok := broker.GetDeadLetter(letter.ID)
+	require.True(t, ok)
+	require.Same(t, letter, found)
+
+	require.True(t, broker.ReplayDeadLetter(letter.ID))
+	require.False(t, broker.ReplayDeadLetter(letter.ID))
+	msg = <-sub.GetMessages()
+	require.Equal(t, "charge", msg.GetContent())
+	require.Equal(t, 1, msg.GetAttempts())
+	require.Equal(t, published.ID, msg.GetCausationID())
+	require.Equal(t, "acme", msg.GetHeader("tenant"))
+	msg.Nack(false)
+
+	msg = <-dlq.GetMessages()
+	require.Equal(t, 1, msg.GetContent().(*pubsub.DeadLetter).Attempts)
+	msg.Ack()
+	require.Equal(t, 1, broker.PurgeDeadLetters(""))
+	require.Empty(t, broker.DeadLetters(""))
+}
+
+func Test_DeadLetterPerSubscriber(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		AtLeastOnce: true,
+		AckDeadline: 10 * time.Millisecond,
+	})
+
+	sub := broker.AddSubscriber(pubsub.SubscriberOptions{
+		DeadLetter: &pubsub.DeadLetterPolicy{
+			MaxDeliveries: 1,
+			Topic: func(topic string) string {
+				return "failed." + topic
+			},
+		},
+	})
+	broker.Subscribe(sub, "payments")
+	dlq := broker.AddSubscriber()
+	broker.Subscribe(dlq, "failed.payments")
+
+	broker.Publish("payments", "charge")
+	<-sub.GetMessages()
+
+	msg := <-dlq.GetMessages()
+	msg.Ack()
+	letter := msg.GetContent().(*pubsub.DeadLetter)
+	require.Equal(t, pubsub.ReasonAckDeadline, letter.Reason)
+	require.Equal(t, 1, letter.Attempts)
+	require.Empty(t, drain(sub))
+}
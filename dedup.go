@@ -0,0 +1,129 @@
+package pubsub
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDedupWindow is how long an idempotency key suppresses duplicates
+	// when BrokerOptions.DedupWindow is not set.
+	DefaultDedupWindow = 10 * time.Minute
+	// DefaultDedupMaxKeys is the number of idempotency keys remembered when
+	// BrokerOptions.DedupMaxKeys is not set.
+	DefaultDedupMaxKeys = 10000
+)
+
+// WithIdempotencyKey sets the idempotency key of the message, such as the ID
+// of the request that publishes it.
+//
+// The broker publishes a message once per key and topic within the dedup
+// window of the broker: publishing again with the same key is reported by
+// PublishResult.Deduplicated, with the ID of the original message, and
+// nothing is delivered. The keys are remembered in memory only, and the least
+// recently used keys are forgotten first once DedupMaxKeys is reached.
+func WithIdempotencyKey(key string) PublishOption {
+	return func(m *Message) {
+		m.idempotencyKey = key
+	}
+}
+
+// GetIdempotencyKey returns the key given with WithIdempotencyKey, or an empty
+// string.
+func (m *Message) GetIdempotencyKey() string {
+	return m.idempotencyKey
+}
+
+// Deduplicated returns the number of messages the broker did not publish
+// because of their idempotency key.
+func (b *Broker) Deduplicated() uint64 {
+	return b.duplicates.Load()
+}
+
+// dedupKey identifies the messages published with an idempotency key.
+type dedupKey struct {
+	topic string
+	key   string
+}
+
+// dedupEntry is the message first published with an idempotency key.
+type dedupEntry struct {
+	key dedupKey
+	id  string
+	at  time.Time
+}
+
+// dedupCache remembers the idempotency keys published within the window,
+// bounded to the most recently used keys.
+type dedupCache struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	maxKeys int
+	entries map[dedupKey]*list.Element
+	lru     *list.List // Most recently used entries at the front
+}
+
+func newDedupCache(window time.Duration, maxKeys int) *dedupCache {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	if maxKeys <= 0 {
+		maxKeys = DefaultDedupMaxKeys
+	}
+	return &dedupCache{
+		window:  window,
+		maxKeys: maxKeys,
+		entries: map[dedupKey]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// claim records the message under its idempotency key. It returns the ID of
+// the original message and true when the key was published within the
+// window.
+func (c *dedupCache) claim(m *Message) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	key := dedupKey{topic: m.topic, key: m.idempotencyKey}
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*dedupEntry)
+		if now.Sub(entry.at) < c.window {
+			c.lru.MoveToFront(elem)
+			return entry.id, true
+		}
+		entry.id, entry.at = m.id, now
+		c.lru.MoveToFront(elem)
+		return "", false
+	}
+
+	c.entries[key] = c.lru.PushFront(&dedupEntry{key: key, id: m.id, at: now})
+	for c.lru.Len() > c.maxKeys {
+		c.remove(c.lru.Back())
+	}
+	// Expired keys at the back are dropped early to free memory.
+	for back := c.lru.Back(); back != nil && now.Sub(back.Value.(*dedupEntry).at) >= c.window; back = c.lru.Back() {
+		c.remove(back)
+	}
+	return "", false
+}
+
+// release forgets the idempotency key of a message that failed to publish,
+// so it can be published again.
+func (c *dedupCache) release(m *Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[dedupKey{topic: m.topic, key: m.idempotencyKey}]
+	if ok && elem.Value.(*dedupEntry).id == m.id {
+		c.remove(elem)
+	}
+}
+
+// remove drops the entry. The caller must hold the mutex.
+func (c *dedupCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*dedupEntry).key)
+}
@@ -0,0 +1,68 @@
+package pubsub_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_Dedup(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{DedupWindow: 30 * time.Millisecond})
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	broker.Subscribe(sub, "invoices")
+
+	first, err := broker.PublishWithOptions("orders", "created", pubsub.WithIdempotencyKey("req-1"))
+	require.Nil(t, err)
+	require.False(t, first.Deduplicated)
+	require.Equal(t, 1, first.Delivered)
+
+	retry, err := broker.PublishWithOptions("orders", "created again", pubsub.WithIdempotencyKey("req-1"))
+	require.Nil(t, err)
+	require.True(t, retry.Deduplicated)
+	require.Equal(t, first.ID, retry.ID)
+	require.Zero(t, retry.Delivered)
+
+	// The key is scoped to the topic, and messages without a key are never
+	// deduplicated.
+	other, err := broker.PublishWithOptions("invoices", "issued", pubsub.WithIdempotencyKey("req-1"))
+	require.Nil(t, err)
+	require.False(t, other.Deduplicated)
+	broker.Publish("orders", "plain")
+	broker.Publish("orders", "plain")
+
+	msg := <-sub.GetMessages()
+	require.Equal(t, "created", msg.GetContent())
+	require.Equal(t, "req-1", msg.GetIdempotencyKey())
+	require.Equal(t, []any{"issued", "plain", "plain"}, drain(sub))
+	require.Equal(t, uint64(1), broker.Deduplicated())
+
+	// Once the window has elapsed, the key is accepted again.
+	time.Sleep(40 * time.Millisecond)
+	later, err := broker.PublishWithOptions("orders", "created later", pubsub.WithIdempotencyKey("req-1"))
+	require.Nil(t, err)
+	require.False(t, later.Deduplicated)
+	require.NotEqual(t, first.ID, later.ID)
+	require.Equal(t, []any{"created later"}, drain(sub))
+}
+
+func Test_DedupMaxKeys(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{DedupMaxKeys: 2})
+
+	publish := func(key string) bool {
+		result, err := broker.PublishWithOptions("orders", key, pubsub.WithIdempotencyKey(key))
+		require.Nil(t, err)
+		return result.Deduplicated
+	}
+	require.False(t, publish("a"))
+	require.False(t, publish("b"))
+	require.True(t, publish("a"))
+
+	// The least recently used key is forgotten first.
+	require.False(t, publish("c"))
+	require.True(t, publish("a"))
+	require.False(t, publish("b"))
+	require.Equal(t, uint64(2), broker.Deduplicated())
+}
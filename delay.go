@@ -0,0 +1,428 @@
+package pubsub
+
+import (
+	"cmp"
+	"container/heap"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ScheduledMessage is a message waiting to be published, scheduled with
+// PublishAt or PublishAfter.
+type ScheduledMessage struct {
+	ID        string
+	Topic     string
+	Payload   any
+	DeliverAt time.Time
+}
+
+// ScheduledRecord is a scheduled message persisted in a ScheduledStore.
+type ScheduledRecord struct {
+	Record
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+// ScheduledStore is implemented by the stores able to persist the messages
+// scheduled with PublishAt and PublishAfter, so they survive a restart.
+//
+// The broker saves each message when it is scheduled and removes it once it
+// is published or cancelled. A message scheduled again with the same ID
+// replaces the saved one.
+type ScheduledStore interface {
+	// AddScheduled saves the scheduled message.
+	AddScheduled(record *ScheduledRecord) error
+	// RemoveScheduled removes the scheduled messages with the given IDs.
+	// Unknown IDs are ignored.
+	RemoveScheduled(ids ...string) error
+	// LoadScheduled returns the scheduled messages saved in the store, in
+	// the order they were added.
+	LoadScheduled() ([]*ScheduledRecord, error)
+}
+
+// scheduler publishes the scheduled messages of a broker when they are due.
+//
+// The messages wait in a heap ordered by time, served by a single goroutine
+// sleeping until the next one is due. The goroutine starts with the first
+// scheduled message and stops when the broker shuts down.
+type scheduler struct {
+	broker  *Broker
+	store   ScheduledStore // Nil when the messages are not persisted
+	mutex   sync.Mutex
+	queue   scheduledQueue
+	entries map[string]*scheduled
+	seq     uint64
+	wake    chan struct{}
+	done    chan struct{}
+	exited  chan struct{} // Closed when the goroutine returns
+	running bool
+	held    []*scheduled // Loaded from the store, queued once Recover is called
+	stopped bool
+}
+
+type scheduled struct {
+	msg    *Message
+	at     time.Time
+	seq    uint64 // Orders the messages scheduled at the same time
+	record *ScheduledRecord
+	index  int
+}
+
+// scheduledQueue is a heap of the scheduled messages, the next one first.
+type scheduledQueue []*scheduled
+
+func (q scheduledQueue) Len() int { return len(q) }
+
+func (q scheduledQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+
+func (q scheduledQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduledQueue) Push(x any) {
+	entry := x.(*scheduled)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *scheduledQueue) Pop() any {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return entry
+}
+
+func newScheduler(b *Broker) *scheduler {
+	s := &scheduler{
+		broker:  b,
+		entries: map[string]*scheduled{},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	if store, ok := b.opt.Store.(ScheduledStore); ok {
+		s.store = store
+	}
+	return s
+}
+
+// PublishAt publishes the payload to the topic at the given time, like
+// PublishWithOptions, and returns the ID of the message.
+//
+// The message is created with its ID and metadata when it is scheduled, and
+// gets its publish timestamp when it is published. A time in the past
+// publishes it right away. Until then, the message is listed by Scheduled and
+// can be cancelled with CancelScheduled.
+//
+// When the store of the broker is a ScheduledStore, such as FileStore, the
+// scheduled messages are saved in the store and published by the next run of
+// the broker. The messages saved by a previous run are only published once
+// Recover is called, so they reach the subscribers set up by then. Without a
+// store, the messages still scheduled at shutdown are dropped.
+//
+// It returns ErrBrokerClosed when the broker is shut down, ErrInvalidTopic
+// for an invalid topic, ErrAlreadyScheduled when a message with the same ID
+// is scheduled, and the errors of the store or its codec.
+func (b *Broker) PublishAt(topic string, payload any, at time.Time, opts ...PublishOption) (string, error) {
+	if b.closed.Load() {
+		return "", ErrBrokerClosed
+	}
+	if err := b.checkTopic(topic, true); err != nil {
+		return "", err
+	}
+
+	msg, err := b.newPublished(topic, payload, opts...)
+	if err != nil {
+		return "", err
+	}
+	if err := b.scheduler.schedule(msg, at); err != nil {
+		return "", err
+	}
+	return msg.id, nil
+}
+
+// PublishAfter publishes the payload to the topic once the delay has elapsed,
+// like PublishAt.
+func (b *Broker) PublishAfter(topic string, payload any, delay time.Duration, opts ...PublishOption) (string, error) {
+	return b.PublishAt(topic, payload, time.Now().Add(delay), opts...)
+}
+
+// CancelScheduled cancels the scheduled message with the given ID. It reports
+// false when no such message is waiting to be published.
+func (b *Broker) CancelScheduled(id string) bool {
+	return b.scheduler.cancel(id)
+}
+
+// Scheduled returns the messages waiting to be published, the next one first.
+func (b *Broker) Scheduled() []ScheduledMessage {
+	return b.scheduler.list()
+}
+
+// publishScheduled publishes the scheduled message now.
+func (b *Broker) publishScheduled(msg *Message) {
+	msg.publishedAt = time.Now()
+	if _, err := b.publish(msg); err != nil {
+		log.Printf("pubsub: publish scheduled message %s: %v\n", msg.id, err)
+	}
+}
+
+// schedule adds the message to the queue.
+func (s *scheduler) schedule(m *Message, at time.Time) error {
+	entry := &scheduled{msg: m, at: at}
+	if s.store != nil {
+		payload, err := s.broker.journal.codec.Marshal(m.topic, m.content)
+		if err != nil {
+			return err
+		}
+		entry.record = &ScheduledRecord{Record: *newRecord(m, payload), DeliverAt: at}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return ErrBrokerClosed
+	}
+	if _, ok := s.entries[m.id]; ok {
+		return ErrAlreadyScheduled
+	}
+	if entry.record != nil {
+		if err := s.store.AddScheduled(entry.record); err != nil {
+			return err
+		}
+	}
+	s.push(entry)
+
+	s.start()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// load adds the messages saved in the store to the queue.
+func (s *scheduler) load() error {
+	if s.store == nil {
+		return nil
+	}
+	records, err := s.store.LoadScheduled()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var errs []error
+	for _, record := range records {
+		m, err := s.broker.journal.message(&record.Record, s.broker)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.offset = 0
+		s.seq++
+		entry := &scheduled{msg: m, at: record.DeliverAt, seq: s.seq, record: record}
+		s.held = append(s.held, entry)
+		s.entries[m.id] = entry
+	}
+	return errors.Join(errs...)
+}
+
+// release queues the messages loaded from the store, once Recover is called.
+func (s *scheduler) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.held) == 0 {
+		return
+	}
+	for _, entry := range s.held {
+		heap.Push(&s.queue, entry)
+	}
+	s.held = nil
+	s.start()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start runs the goroutine publishing the messages, unless it is running.
+// The caller must hold the mutex.
+func (s *scheduler) start() {
+	if s.running || s.stopped {
+		return
+	}
+	s.running = true
+	go s.run()
+}
+
+// stop stops publishing the messages, and waits for the messages being
+// published.
+func (s *scheduler) stop() {
+	s.mutex.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.done)
+	}
+	running := s.running
+	s.mutex.Unlock()
+
+	if running {
+		<-s.exited
+	}
+}
+
+// run publishes the messages when they are due, until the scheduler stops.
+func (s *scheduler) run() {
+	defer close(s.exited)
+
+	for {
+		due, wait := s.due(time.Now())
+		if s.broker.closed.Load() {
+			// The messages due stay in the store, if any.
+			return
+		}
+		if len(due) > 0 {
+			for _, m := range due {
+				s.broker.publishScheduled(m)
+			}
+			// The messages are removed from the store once they are
+			// published, so a crash in between publishes them again rather
+			// than losing them.
+			s.forget(due)
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+		case <-s.wake:
+		case <-s.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+	}
+}
+
+// due removes the messages due at the given time from the queue, and returns
+// them with the time until the next one, or -1 when the queue is empty.
+func (s *scheduler) due(now time.Time) ([]*Message, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var messages []*Message
+	for len(s.queue) > 0 && !s.queue[0].at.After(now) && !s.stopped {
+		entry := heap.Pop(&s.queue).(*scheduled)
+		delete(s.entries, entry.msg.id)
+		messages = append(messages, entry.msg)
+	}
+	if len(s.queue) == 0 {
+		return messages, -1
+	}
+	return messages, s.queue[0].at.Sub(now)
+}
+
+// cancel removes the message with the given ID from the queue.
+func (s *scheduler) cancel(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[id]
+	if !ok {
+		return false
+	}
+	s.remove(entry)
+	if s.store != nil {
+		if err := s.store.RemoveScheduled(id); err != nil {
+			log.Printf("pubsub: remove scheduled message %s: %v\n", id, err)
+		}
+	}
+	return true
+}
+
+// list returns the scheduled messages, the next one first.
+func (s *scheduler) list() []ScheduledMessage {
+	s.mutex.Lock()
+	entries := slices.Concat(s.queue, s.held)
+	s.mutex.Unlock()
+
+	slices.SortFunc(entries, func(x, y *scheduled) int {
+		if c := x.at.Compare(y.at); c != 0 {
+			return c
+		}
+		return cmp.Compare(x.seq, y.seq)
+	})
+	messages := make([]ScheduledMessage, 0, len(entries))
+	for _, entry := range entries {
+		messages = append(messages, ScheduledMessage{
+			ID:        entry.msg.id,
+			Topic:     entry.msg.topic,
+			Payload:   entry.msg.content,
+			DeliverAt: entry.at,
+		})
+	}
+	return messages
+}
+
+// push adds the entry to the queue. The caller must hold the mutex.
+func (s *scheduler) push(entry *scheduled) {
+	s.seq++
+	entry.seq = s.seq
+	heap.Push(&s.queue, entry)
+	s.entries[entry.msg.id] = entry
+}
+
+// remove removes the entry from the queue, or from the held messages. The
+// caller must hold the mutex.
+func (s *scheduler) remove(entry *scheduled) {
+	if i := slices.Index(s.held, entry); i >= 0 {
+		s.held = slices.Delete(s.held, i, i+1)
+	} else {
+		heap.Remove(&s.queue, entry.index)
+	}
+	delete(s.entries, entry.msg.id)
+}
+
+// forget removes the published messages from the store, except the ones
+// scheduled again with the same ID since.
+func (s *scheduler) forget(published []*Message) {
+	if s.store == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := make([]string, 0, len(published))
+	for _, m := range published {
+		if _, ok := s.entries[m.id]; !ok {
+			ids = append(ids, m.id)
+		}
+	}
+	if err := s.store.RemoveScheduled(ids...); err != nil {
+		log.Printf("pubsub: remove scheduled messages: %v\n", err)
+	}
+}
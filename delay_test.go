@@ -0,0 +1,142 @@
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_PublishAfter(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "reminders")
+
+	start := time.Now()
+	late, err := broker.PublishAfter("reminders", "late", 60*time.Millisecond)
+	require.Nil(t, err)
+	_, err = broker.PublishAfter("reminders", "soon", 20*time.Millisecond, pubsub.WithMessageID("soon"))
+	require.Nil(t, err)
+	cancelled, err := broker.PublishAt("reminders", "cancelled", start.Add(40*time.Millisecond))
+	require.Nil(t, err)
+
+	_, err = broker.PublishAfter("reminders", "again", time.Second, pubsub.WithMessageID("soon"))
+	require.ErrorIs(t, err, pubsub.ErrAlreadyScheduled)
+	_, err = broker.PublishAfter("", "invalid", time.Second)
+	require.ErrorIs(t, err, pubsub.ErrInvalidTopic)
+
+	scheduled := broker.Scheduled()
+	require.Len(t, scheduled, 3)
+	require.Equal(t, "soon", scheduled[0].ID)
+	require.Equal(t, cancelled, scheduled[1].ID)
+	require.Equal(t, late, scheduled[2].ID)
+	require.Equal(t, "late", scheduled[2].Payload)
+
+	require.True(t, broker.CancelScheduled(cancelled))
+	require.False(t, broker.CancelScheduled(cancelled))
+
+	msg := <-sub.GetMessages()
+	require.Equal(t, "soon", msg.GetContent())
+	require.Equal(t, "soon", msg.GetID())
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	msg = <-sub.GetMessages()
+	require.Equal(t, "late", msg.GetContent())
+	require.Equal(t, late, msg.GetID())
+	require.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+	require.Empty(t, drain(sub))
+	require.Empty(t, broker.Scheduled())
+
+	// A time in the past publishes right away.
+	_, err = broker.PublishAt("reminders", "now", start)
+	require.Nil(t, err)
+	require.Equal(t, []any{"now"}, drain(sub))
+
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+	_, err = broker.PublishAfter("reminders", "closed", time.Millisecond)
+	require.ErrorIs(t, err, pubsub.ErrBrokerClosed)
+}
+
+func Test_PublishAtRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	_, err := broker.Recover()
+	require.Nil(t, err)
+	_, err = broker.PublishAfter("reminders", "due", 20*time.Millisecond, pubsub.WithHeader("kind", "invoice"))
+	require.Nil(t, err)
+	id, err := broker.PublishAfter("reminders", "later", time.Hour)
+	require.Nil(t, err)
+	cancelled, err := broker.PublishAfter("reminders", "cancelled", time.Hour)
+	require.Nil(t, err)
+	require.True(t, broker.CancelScheduled(cancelled))
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	// The scheduled messages survive the restart, and are published once
+	// Recover is called.
+	time.Sleep(30 * time.Millisecond)
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	scheduled := broker.Scheduled()
+	require.Len(t, scheduled, 2)
+	require.Equal(t, "due", scheduled[0].Payload)
+	require.Equal(t, id, scheduled[1].ID)
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "reminders")
+	require.Empty(t, drain(sub))
+
+	_, err = broker.Recover()
+	require.Nil(t, err)
+	msg := <-sub.GetMessages()
+	require.Equal(t, "due", msg.GetContent())
+	require.Equal(t, "invoice", msg.GetHeader("kind"))
+	require.Len(t, broker.Scheduled(), 1)
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	scheduled = broker.Scheduled()
+	require.Len(t, scheduled, 1)
+	require.Equal(t, id, scheduled[0].ID)
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+}
+
+func Test_PublishAfterWithoutRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	// Messages scheduled by this run are published even though Recover is
+	// never called, only those saved by a previous run wait for it.
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "reminders")
+	_, err := broker.PublishAfter("reminders", "soon", 10*time.Millisecond)
+	require.Nil(t, err)
+	later, err := broker.PublishAfter("reminders", "later", time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, "soon", (<-sub.GetMessages()).GetContent())
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	_, err = broker.PublishAfter("reminders", "next", time.Hour)
+	require.Nil(t, err)
+	scheduled := broker.Scheduled()
+	require.Len(t, scheduled, 2)
+	require.Equal(t, later, scheduled[0].ID)
+	require.True(t, broker.CancelScheduled(later))
+	require.Len(t, broker.Scheduled(), 1)
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	scheduled = broker.Scheduled()
+	require.Len(t, scheduled, 1)
+	require.Equal(t, "next", scheduled[0].Payload)
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+}
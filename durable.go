@@ -0,0 +1,475 @@
+package pubsub
+
+import (
+	"log"
+	"slices"
+	"sync"
+)
+
+// DurableSubscription describes a durable subscription remembered by the
+// broker.
+type DurableSubscription struct {
+	Name      string
+	Topics    []string
+	Position  uint64 // Offset in the store from which the subscription resumes
+	Connected bool
+}
+
+// Checkpoint is the state of a durable subscription saved in a Store.
+type Checkpoint struct {
+	Topics   []string `json:"topics"`
+	Position uint64   `json:"position"`
+}
+
+// Checkpointer is implemented by the stores that can save the state of the
+// durable subscriptions, so they survive a restart of the broker.
+type Checkpointer interface {
+	// SaveCheckpoints replaces the saved checkpoints, keyed by the name of
+	// the durable subscription.
+	SaveCheckpoints(checkpoints map[string]Checkpoint) error
+	// LoadCheckpoints returns the saved checkpoints.
+	LoadCheckpoints() (map[string]Checkpoint, error)
+}
+
+type durables struct {
+	mutex   sync.Mutex
+	entries map[string]*durable
+}
+
+func newDurables() *durables {
+	return &durables{entries: map[string]*durable{}}
+}
+
+type durable struct {
+	name       string
+	mutex      sync.Mutex
+	topics     []string
+	position   uint64         // Offset to resume from, while disconnected
+	sub        *Subscriber    // Connected subscriber, nil while disconnected
+	pending    map[uint64]int // Offsets handed to the subscriber and not completed
+	catchingUp bool
+	cursor     uint64     // Offset after the last record replayed
+	held       []*Message // Messages published while catching up
+}
+
+// AddDurableSubscriber adds a durable subscriber identified by the given
+// name to the broker and subscribes it to the topics.
+//
+// The broker remembers the topics and the position of a durable subscription
+// after its subscriber is removed. A subscriber added later under the same
+// name, for instance by the same service after a restart, is subscribed to
+// the remembered topics as well and resumes where the previous one left off:
+// the messages it missed are replayed from the Store of the broker before
+// the new ones. Without AtLeastOnce, the position moves past a message once
+// the subscriber receives it; with AtLeastOnce, once it is acknowledged or
+// dead-lettered.
+//
+// Without a Store, only the topics of the subscription are remembered and
+// the messages published while it is disconnected are missed. With a Store
+// implementing Checkpointer, the subscriptions also survive a restart of the
+// broker.
+//
+// The subscriber is nil when it could not be added; use
+// TryAddDurableSubscriber to know why.
+func (b *Broker) AddDurableSubscriber(name string, topics ...string) *Subscriber {
+	s, _ := b.TryAddDurableSubscriber(name, topics...)
+	return s
+}
+
+// TryAddDurableSubscriber works like AddDurableSubscriber, but returns the
+// error that prevented adding the subscriber: ErrInvalidDurable for an empty
+// name, ErrDurableInUse when a subscriber is already connected under the
+// name, or the errors of TryAddSubscriber and TrySubscribe.
+func (b *Broker) TryAddDurableSubscriber(name string, topics ...string) (*Subscriber, error) {
+	if name == "" {
+		return nil, ErrInvalidDurable
+	}
+	for _, topic := range topics {
+		if err := b.checkTopic(topic, false); err != nil {
+			return nil, err
+		}
+	}
+
+	b.durables.mutex.Lock()
+	d := b.durables.entries[name]
+	created := d == nil
+	if created {
+		d = &durable{name: name}
+		if b.journal != nil {
+			// A new subscription starts with the next message.
+			d.position = b.journal.inflightOffset()
+		}
+		b.durables.entries[name] = d
+	}
+	b.durables.mutex.Unlock()
+
+	s, err := b.addSubscriber(name)
+	if err != nil {
+		if created {
+			b.durables.mutex.Lock()
+			delete(b.durables.entries, name)
+			b.durables.mutex.Unlock()
+		}
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	if d.sub != nil {
+		d.mutex.Unlock()
+		b.RemoveSubscriber(s)
+		return nil, ErrDurableInUse
+	}
+	s.durable = d
+	d.sub = s
+	d.pending = map[uint64]int{}
+	d.catchingUp = b.journal != nil
+	d.cursor = d.position
+	d.held = nil
+	for _, topic := range topics {
+		if !slices.Contains(d.topics, topic) {
+			d.topics = append(d.topics, topic)
+		}
+	}
+	subscribed := slices.Clone(d.topics)
+	d.mutex.Unlock()
+
+	for _, topic := range subscribed {
+		if err := b.TrySubscribe(s, topic); err != nil {
+			b.RemoveSubscriber(s)
+			return nil, err
+		}
+	}
+	if b.journal != nil {
+		b.journal.saveCheckpoints()
+		// Messages appended from now on are delivered to the subscriber
+		// without being replayed.
+		go b.catchUp(d, s, b.journal.nextOffset())
+	}
+	return s, nil
+}
+
+// GetDurable returns the durable subscription with the given name.
+func (b *Broker) GetDurable(name string) (DurableSubscription, bool) {
+	b.durables.mutex.Lock()
+	d := b.durables.entries[name]
+	b.durables.mutex.Unlock()
+	if d == nil {
+		return DurableSubscription{}, false
+	}
+
+	var inflight uint64
+	if b.journal != nil {
+		inflight = b.journal.inflightOffset()
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return DurableSubscription{
+		Name:      d.name,
+		Topics:    slices.Clone(d.topics),
+		Position:  d.resumeFrom(inflight),
+		Connected: d.sub != nil,
+	}, true
+}
+
+// Durables returns the durable subscriptions remembered by the broker,
+// sorted by name.
+func (b *Broker) Durables() []DurableSubscription {
+	b.durables.mutex.Lock()
+	names := make([]string, 0, len(b.durables.entries))
+	for name := range b.durables.entries {
+		names = append(names, name)
+	}
+	b.durables.mutex.Unlock()
+	slices.Sort(names)
+
+	subscriptions := []DurableSubscription{}
+	for _, name := range names {
+		if subscription, ok := b.GetDurable(name); ok {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	return subscriptions
+}
+
+// RemoveDurable forgets the durable subscription with the given name and
+// removes its subscriber when it is connected. The store no longer keeps
+// messages for it. It reports false when no such subscription exists.
+func (b *Broker) RemoveDurable(name string) bool {
+	b.durables.mutex.Lock()
+	d := b.durables.entries[name]
+	delete(b.durables.entries, name)
+	b.durables.mutex.Unlock()
+	if d == nil {
+		return false
+	}
+
+	d.mutex.Lock()
+	s := d.sub
+	d.mutex.Unlock()
+	if s != nil {
+		b.RemoveSubscriber(s)
+	}
+	if b.journal != nil {
+		b.journal.saveCheckpoints()
+	}
+	return true
+}
+
+// disconnect remembers the position of the durable subscription of the
+// subscriber being removed.
+func (b *Broker) disconnect(s *Subscriber) {
+	d := s.durable
+	var inflight uint64
+	if b.journal != nil {
+		inflight = b.journal.inflightOffset()
+	}
+
+	d.mutex.Lock()
+	if d.sub != s {
+		d.mutex.Unlock()
+		return
+	}
+	d.position = d.resumeFrom(inflight)
+	d.sub = nil
+	d.pending = nil
+	d.catchingUp = false
+	held := d.held
+	d.held = nil
+	d.mutex.Unlock()
+
+	for _, m := range held {
+		m.discard()
+	}
+	if b.journal != nil {
+		b.journal.saveCheckpoints()
+	}
+}
+
+// catchUp replays the records of the store the durable subscription has not
+// received, up to the given end offset, then hands over the messages
+// published meanwhile.
+func (b *Broker) catchUp(d *durable, s *Subscriber, end uint64) {
+replay:
+	for {
+		d.mutex.Lock()
+		if d.sub != s {
+			d.mutex.Unlock()
+			return
+		}
+		from := d.cursor
+		if from >= end {
+			d.mutex.Unlock()
+			break
+		}
+		matchers := make([]func(string) bool, 0, len(d.topics))
+		for _, topic := range d.topics {
+			matchers = append(matchers, b.topicMatcher(topic))
+		}
+		d.mutex.Unlock()
+
+		records, err := b.journal.store.Read(from, recoverBatch)
+		if err != nil {
+			log.Printf("pubsub: replay durable subscription %s: %v\n", d.name, err)
+			break
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, record := range records {
+			if record.Offset >= end {
+				break replay
+			}
+			if slices.ContainsFunc(matchers, func(match func(string) bool) bool {
+				return match(record.Topic)
+			}) {
+				m, err := b.journal.message(record, b)
+				if err != nil {
+					log.Printf("pubsub: replay durable subscription %s: %v\n", d.name, err)
+				} else {
+					m.ticket = b.journal.ticket(record.Offset, d)
+					b.signal(s, m)
+				}
+			}
+
+			d.mutex.Lock()
+			if d.sub != s {
+				d.mutex.Unlock()
+				return
+			}
+			d.cursor = record.Offset + 1
+			d.mutex.Unlock()
+		}
+	}
+
+	d.mutex.Lock()
+	if d.sub != s {
+		d.mutex.Unlock()
+		return
+	}
+	held := d.held
+	d.held = nil
+	d.catchingUp = false
+	d.cursor = max(d.cursor, end)
+	d.mutex.Unlock()
+
+	for _, m := range held {
+		if m.offset < end {
+			// Already replayed.
+			m.ticket.release()
+			continue
+		}
+		b.signal(s, m)
+	}
+}
+
+// admit reports whether a published message can be handed to the subscriber
+// of the durable subscription. Messages published while the subscription is
+// catching up are held until the replay is over, and messages already
+// replayed are skipped.
+func (d *durable) admit(m *Message) bool {
+	d.mutex.Lock()
+	if d.catchingUp {
+		d.held = append(d.held, m)
+		d.mutex.Unlock()
+		return false
+	}
+	replayed := m.ticket != nil && m.offset < d.cursor
+	d.mutex.Unlock()
+
+	if replayed {
+		m.ticket.release()
+		return false
+	}
+	return true
+}
+
+// hold records a message handed to the subscriber.
+func (d *durable) hold(offset uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.pending != nil {
+		d.pending[offset]++
+	}
+}
+
+// complete records a message received, or acknowledged, by the subscriber.
+func (d *durable) complete(offset uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.pending == nil {
+		return
+	}
+	d.pending[offset]--
+	if d.pending[offset] <= 0 {
+		delete(d.pending, offset)
+	}
+}
+
+// resumeFrom returns the offset the subscription resumes from. A connected
+// subscription resumes from its oldest message not completed, or from the
+// oldest message being published. The caller must hold the mutex.
+func (d *durable) resumeFrom(inflight uint64) uint64 {
+	if d.sub == nil {
+		return d.position
+	}
+
+	position := inflight
+	if d.catchingUp {
+		position = min(position, d.cursor)
+	}
+	for offset := range d.pending {
+		position = min(position, offset)
+	}
+	return position
+}
+
+// addTopic remembers a topic the subscriber of the durable subscription
+// subscribed to.
+func (d *durable) addTopic(s *Subscriber, topic string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.sub == s && !slices.Contains(d.topics, topic) {
+		d.topics = append(d.topics, topic)
+	}
+}
+
+// removeTopic forgets a topic the subscriber of the durable subscription
+// unsubscribed from.
+func (d *durable) removeTopic(s *Subscriber, topic string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.sub == s {
+		d.topics = slices.DeleteFunc(d.topics, func(t string) bool {
+			return t == topic
+		})
+	}
+}
+
+// checkpoint returns the positions of the durable subscriptions and saves
+// them when the store is a Checkpointer. The caller must hold the mutex.
+func (j *journal) checkpoint() map[string]uint64 {
+	inflight := j.inflight()
+
+	j.durables.mutex.Lock()
+	entries := make([]*durable, 0, len(j.durables.entries))
+	for _, d := range j.durables.entries {
+		entries = append(entries, d)
+	}
+	j.durables.mutex.Unlock()
+
+	positions := map[string]uint64{}
+	checkpoints := map[string]Checkpoint{}
+	for _, d := range entries {
+		d.mutex.Lock()
+		positions[d.name] = d.resumeFrom(inflight)
+		checkpoints[d.name] = Checkpoint{
+			Topics:   slices.Clone(d.topics),
+			Position: positions[d.name],
+		}
+		d.mutex.Unlock()
+	}
+
+	if checkpointer, ok := j.store.(Checkpointer); ok {
+		if err := checkpointer.SaveCheckpoints(checkpoints); err != nil {
+			log.Println(err)
+		}
+	}
+	return positions
+}
+
+// saveCheckpoints works like checkpoint, taking the mutex.
+func (j *journal) saveCheckpoints() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.checkpoint()
+}
+
+// loadCheckpoints restores the durable subscriptions saved in the store.
+func (j *journal) loadCheckpoints() error {
+	checkpointer, ok := j.store.(Checkpointer)
+	if !ok {
+		return nil
+	}
+	checkpoints, err := checkpointer.LoadCheckpoints()
+	if err != nil {
+		return err
+	}
+
+	j.durables.mutex.Lock()
+	defer j.durables.mutex.Unlock()
+
+	for name, checkpoint := range checkpoints {
+		j.durables.entries[name] = &durable{
+			name:     name,
+			topics:   checkpoint.Topics,
+			position: checkpoint.Position,
+		}
+	}
+	return nil
+}
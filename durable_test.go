@@ -0,0 +1,117 @@
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+func Test_DurableSubscriber(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{Store: pubsub.NewMemoryStore()})
+	_, err := broker.Recover()
+	require.Nil(t, err)
+
+	sub := broker.AddDurableSubscriber("billing", "invoices")
+	require.Equal(t, "billing", sub.ID)
+	broker.Publish("invoices", 1)
+	require.Equal(t, 1, (<-sub.GetMessages()).GetContent())
+
+	_, err = broker.TryAddDurableSubscriber("billing")
+	require.ErrorIs(t, err, pubsub.ErrDurableInUse)
+	_, err = broker.TryAddDurableSubscriber("")
+	require.ErrorIs(t, err, pubsub.ErrInvalidDurable)
+
+	broker.RemoveSubscriber(sub)
+	for i := 2; i <= 300; i++ {
+		broker.Publish("invoices", i)
+	}
+	broker.Publish("orders", "ignored")
+
+	durable, ok := broker.GetDurable("billing")
+	require.True(t, ok)
+	require.False(t, durable.Connected)
+	require.Equal(t, []string{"invoices"}, durable.Topics)
+
+	// The messages missed while disconnected are replayed, even though the
+	// store was truncated meanwhile.
+	sub = broker.AddDurableSubscriber("billing")
+	for i := 2; i <= 300; i++ {
+		require.Equal(t, float64(i), (<-sub.GetMessages()).GetContent())
+	}
+	broker.Publish("invoices", 301)
+	require.Equal(t, 301, (<-sub.GetMessages()).GetContent())
+	require.Empty(t, drain(sub))
+
+	require.Len(t, broker.Durables(), 1)
+	require.True(t, broker.RemoveDurable("billing"))
+	require.False(t, broker.RemoveDurable("billing"))
+	require.False(t, sub.IsActive())
+	_, ok = broker.GetDurable("billing")
+	require.False(t, ok)
+}
+
+func Test_DurableRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	_, err := broker.Recover()
+	require.Nil(t, err)
+	sub := broker.AddDurableSubscriber("billing", "invoices")
+	broker.Publish("invoices", "first")
+	require.Equal(t, "first", (<-sub.GetMessages()).GetContent())
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{
+			AtLeastOnce: true,
+			AckDeadline: 100 * time.Millisecond,
+			Store:       openStore(t, dir),
+		})},
+	})
+	broker = pubsub.InjectBroker(module)
+	_, err = broker.Recover()
+	require.Nil(t, err)
+	broker.Publish("invoices", "second")
+	broker.Publish("invoices", "third")
+
+	durable, ok := broker.GetDurable("billing")
+	require.True(t, ok)
+	require.Equal(t, []string{"invoices"}, durable.Topics)
+
+	sub = broker.AddDurableSubscriber("billing")
+	msg := <-sub.GetMessages()
+	require.Equal(t, "second", msg.GetContent())
+	msg.Ack()
+	require.Equal(t, "third", (<-sub.GetMessages()).GetContent())
+
+	// The unacknowledged message is replayed to the next subscriber.
+	broker.RemoveSubscriber(sub)
+	sub = broker.AddDurableSubscriber("billing")
+	msg = <-sub.GetMessages()
+	require.Equal(t, "third", msg.GetContent())
+	msg.Ack()
+	require.Empty(t, drain(sub))
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+}
+
+func Test_ForFeatureDurable(t *testing.T) {
+	appModule := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{
+			pubsub.ForRoot(pubsub.BrokerOptions{Store: pubsub.NewMemoryStore()}),
+			pubsub.ForFeatureDurable("billing", "invoices"),
+		},
+	})
+	broker := pubsub.InjectBroker(appModule)
+	sub := pubsub.InjectSubscriber(appModule)
+	require.NotNil(t, sub)
+	require.Equal(t, "billing", sub.ID)
+
+	broker.Publish("invoices", 1)
+	require.Equal(t, 1, (<-sub.GetMessages()).GetContent())
+}
@@ -0,0 +1,57 @@
+package pubsub
+
+import "errors"
+
+var (
+	// ErrMaxSubscribers is returned when the broker already has
+	// MaxSubscribers subscribers.
+	ErrMaxSubscribers = errors.New("pubsub: maximum number of subscribers reached")
+	// ErrBrokerClosed is returned when the broker is shut down.
+	ErrBrokerClosed = errors.New("pubsub: broker is closed")
+	// ErrBrokerNotFound is returned when no broker is provided to a module,
+	// usually because ForRoot is not imported.
+	ErrBrokerNotFound = errors.New("pubsub: broker not found")
+	// ErrInvalidTopic is returned for an empty or malformed topic.
+	ErrInvalidTopic = errors.New("pubsub: invalid topic")
+	// ErrNotSubscribed is returned when a subscriber is not subscribed to the
+	// topic.
+	ErrNotSubscribed = errors.New("pubsub: not subscribed to topic")
+	// ErrSubscriberInactive is returned when the subscriber has been removed.
+	ErrSubscriberInactive = errors.New("pubsub: subscriber is inactive")
+	// ErrTypeMismatch is returned when the content of a message does not
+	// have the type expected by a typed topic or handler.
+	ErrTypeMismatch = errors.New("pubsub: payload type mismatch")
+	// ErrNoResponders is returned when a request is published to a topic
+	// without subscribers.
+	ErrNoResponders = errors.New("pubsub: no responders")
+	// ErrNoReplyTo is returned when replying to a message that is not a
+	// request.
+	ErrNoReplyTo = errors.New("pubsub: message has no reply-to topic")
+	// ErrQuorumNotMet is returned when fewer replies than the quorum of a
+	// gather arrive before its deadline.
+	ErrQuorumNotMet = errors.New("pubsub: quorum not met")
+	// ErrInvalidDurable is returned for a durable subscription without a
+	// name.
+	ErrInvalidDurable = errors.New("pubsub: invalid durable subscription name")
+	// ErrDurableInUse is returned when a subscriber is already connected
+	// under the name of a durable subscription.
+	ErrDurableInUse = errors.New("pubsub: durable subscription already connected")
+	// ErrStreamExists is returned when creating a stream for a topic that is
+	// already a stream.
+	ErrStreamExists = errors.New("pubsub: stream already exists")
+	// ErrStreamNotFound is returned when consuming a topic that is not a
+	// stream.
+	ErrStreamNotFound = errors.New("pubsub: stream not found")
+	// ErrCompactionUnsupported is returned when compacting a stream whose
+	// store is not a Compacter.
+	ErrCompactionUnsupported = errors.New("pubsub: store does not support compaction")
+	// ErrAlreadyScheduled is returned when scheduling a message with the ID
+	// of a message already scheduled.
+	ErrAlreadyScheduled = errors.New("pubsub: message already scheduled")
+	// ErrInvalidCron is returned for a cron expression that cannot be
+	// parsed.
+	ErrInvalidCron = errors.New("pubsub: invalid cron expression")
+	// ErrScheduleExists is returned when adding a schedule with the ID of an
+	// existing one.
+	ErrScheduleExists = errors.New("pubsub: schedule already exists")
+)
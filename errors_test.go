@@ -0,0 +1,67 @@
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+func Test_Errors(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		Wildcard:       true,
+		MaxSubscribers: 1,
+	})
+
+	sub, err := broker.TryAddSubscriber()
+	require.Nil(t, err)
+	_, err = broker.TryAddSubscriber()
+	require.ErrorIs(t, err, pubsub.ErrMaxSubscribers)
+
+	require.ErrorIs(t, broker.TrySubscribe(sub, ""), pubsub.ErrInvalidTopic)
+	require.ErrorIs(t, broker.TrySubscribe(sub, "orders..created"), pubsub.ErrInvalidTopic)
+	require.Nil(t, broker.TrySubscribe(sub, "orders.*"))
+
+	require.ErrorIs(t, broker.TryPublish("orders.*", "x"), pubsub.ErrInvalidTopic)
+	require.Nil(t, broker.TryPublish("orders.created", "x"))
+
+	require.ErrorIs(t, broker.TryUnsubscribe(sub, "users"), pubsub.ErrNotSubscribed)
+	require.Nil(t, broker.TryUnsubscribe(sub, "orders.*"))
+
+	broker.RemoveSubscriber(sub)
+	require.ErrorIs(t, broker.TrySubscribe(sub, "orders"), pubsub.ErrSubscriberInactive)
+	require.ErrorIs(t, broker.TrySubscribeGroup(sub, "orders", "workers"), pubsub.ErrSubscriberInactive)
+
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+	_, err = broker.TryAddSubscriber()
+	require.ErrorIs(t, err, pubsub.ErrBrokerClosed)
+	require.ErrorIs(t, broker.TryPublish("orders.created", "x"), pubsub.ErrBrokerClosed)
+}
+
+func Test_TryNewSubscriber(t *testing.T) {
+	sub, err := pubsub.TryNewSubscriber()
+	require.Nil(t, err)
+	require.NotEmpty(t, sub.ID)
+	require.True(t, sub.IsActive())
+}
+
+func Test_TryListen(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{})
+	handler := pubsub.NewHandler(module)
+	err := handler.TryListen(func(msg *pubsub.Message) {}, "BTC")
+	require.ErrorIs(t, err, pubsub.ErrBrokerNotFound)
+	require.Panics(t, func() {
+		handler.Listen(func(msg *pubsub.Message) {}, "BTC")
+	})
+
+	module = core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	handler = pubsub.NewHandler(module)
+	err = handler.TryListen(func(msg *pubsub.Message) {}, "")
+	require.ErrorIs(t, err, pubsub.ErrInvalidTopic)
+	require.Nil(t, handler.TryListen(func(msg *pubsub.Message) {}, "BTC"))
+}
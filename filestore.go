@@ -0,0 +1,813 @@
+package pubsub
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSegmentSize is the size after which a FileStore starts a new
+	// segment file, when no size is configured.
+	DefaultSegmentSize = 64 << 20
+	// DefaultSyncInterval is how often SyncInterval flushes appended records
+	// to disk, when no interval is configured.
+	DefaultSyncInterval = time.Second
+)
+
+const (
+	segmentExt     = ".log"
+	headFile       = "HEAD"
+	checkpointFile = "CHECKPOINTS"
+	scheduledFile  = "SCHEDULED"
+	frameHeader    = 8       // Length and checksum of a record
+	indexInterval  = 4 << 10 // Bytes of records between two entries of a segment index
+	// Entries of the SCHEDULED log before it is rewritten without the
+	// removed messages
+	scheduledCompactMin = 64
+)
+
+// SyncPolicy decides when a FileStore flushes appended records to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes every record before Append returns. This is the
+	// default.
+	SyncAlways SyncPolicy = iota + 1
+	// SyncInterval flushes appended records every SyncInterval from a
+	// background goroutine, so a crash loses the records of the last interval.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+type FileStoreOptions struct {
+	// the size after which a new segment file is started, defaults to
+	// DefaultSegmentSize
+	SegmentSize int64
+	// when appended records are flushed to disk, defaults to SyncAlways
+	Sync SyncPolicy
+	// how often SyncInterval flushes appended records, defaults to
+	// DefaultSyncInterval
+	SyncInterval time.Duration
+}
+
+// FileStore is a Store writing the records to a write-ahead log on disk.
+//
+// The log is split in segment files named after the offset of their first
+// record. Each record is framed by its length and checksum, so a record torn
+// by a crash is detected and cut off when the store is opened again. A sparse
+// index of the positions of the records in each segment is kept in memory, so
+// reading starts close to the requested offset.
+// Truncating the log deletes the segments holding only removed records, and
+// the first offset kept is saved in a HEAD file. Compacting it rewrites the
+// sealed segments without the dropped records. The checkpoints of the
+// durable subscriptions are saved in a CHECKPOINTS file. The scheduled
+// messages are appended to a SCHEDULED log when they are added and removed,
+// framed like the records, and the log is rewritten once most of its entries
+// are removed messages.
+type FileStore struct {
+	dir       string
+	opt       FileStoreOptions
+	mutex     sync.Mutex
+	segments  []*segment
+	active    *os.File // Last segment, open for appending
+	first     uint64
+	next      uint64
+	dirty     bool          // Records appended since the last flush
+	done      chan struct{} // Closed with the store to stop flushing
+	closed    bool
+	scheduled scheduledLog
+}
+
+// scheduledLog is the SCHEDULED log of a FileStore.
+type scheduledLog struct {
+	file    *os.File        // Open for appending once an entry is added
+	ids     map[string]bool // Messages saved in the log
+	entries int
+	dirty   bool // Entries appended since the last flush
+}
+
+// scheduledEntry is an entry of the SCHEDULED log: a scheduled message, or
+// the IDs of removed messages.
+type scheduledEntry struct {
+	Add    *ScheduledRecord `json:"add,omitempty"`
+	Remove []string         `json:"remove,omitempty"`
+}
+
+type segment struct {
+	base  uint64 // Offset of the first record
+	next  uint64 // Offset after the last record
+	path  string
+	size  int64
+	index []indexEntry // Sparse positions of the records, by offset
+}
+
+// indexEntry is the position of a record in its segment file.
+type indexEntry struct {
+	offset uint64
+	pos    int64
+}
+
+// track adds the record written at the given position to the index of the
+// segment, when it is at least indexInterval bytes after the last entry.
+func (seg *segment) track(offset uint64, pos int64) {
+	if n := len(seg.index); n > 0 && pos-seg.index[n-1].pos < indexInterval {
+		return
+	}
+	seg.index = append(seg.index, indexEntry{offset: offset, pos: pos})
+}
+
+// seek returns the position in the segment file of the last indexed record
+// at or before the given offset, where reading the offset starts.
+func (seg *segment) seek(offset uint64) int64 {
+	i := sort.Search(len(seg.index), func(i int) bool {
+		return seg.index[i].offset > offset
+	})
+	if i == 0 {
+		return 0
+	}
+	return seg.index[i-1].pos
+}
+
+// OpenFileStore opens the write-ahead log in the given directory, creating
+// the directory when it does not exist.
+func OpenFileStore(dir string, opts ...FileStoreOptions) (*FileStore, error) {
+	var opt FileStoreOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.SegmentSize <= 0 {
+		opt.SegmentSize = DefaultSegmentSize
+	}
+	if opt.Sync == 0 {
+		opt.Sync = SyncAlways
+	}
+	if opt.SyncInterval <= 0 {
+		opt.SyncInterval = DefaultSyncInterval
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("pubsub: open store: %w", err)
+	}
+	s := &FileStore{dir: dir, opt: opt, done: make(chan struct{})}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("pubsub: open store: %w", err)
+	}
+	if opt.Sync == SyncInterval {
+		go s.flushEvery()
+	}
+	return s, nil
+}
+
+// load scans the segments of the log and opens the last one for appending.
+// A torn record at the end of the last segment is cut off.
+func (s *FileStore) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{base: base, path: filepath.Join(s.dir, name)})
+	}
+	slices.SortFunc(s.segments, func(x, y *segment) int {
+		return cmp.Compare(x.base, y.base)
+	})
+
+	for i, seg := range s.segments {
+		seg.next = seg.base
+		valid, torn, err := readFrames(seg.path, 0, func(record *Record, pos int64) bool {
+			seg.next = record.Offset + 1
+			seg.track(record.Offset, pos)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		seg.size = valid
+		if torn {
+			if i < len(s.segments)-1 {
+				return fmt.Errorf("corrupt segment %s", seg.path)
+			}
+			if err := os.Truncate(seg.path, valid); err != nil {
+				return err
+			}
+		}
+	}
+
+	scheduled, n, err := s.replayScheduled()
+	if err != nil {
+		return err
+	}
+	s.scheduled = scheduledLog{ids: map[string]bool{}, entries: n}
+	for _, record := range scheduled {
+		s.scheduled.ids[record.ID] = true
+	}
+
+	head, err := os.ReadFile(filepath.Join(s.dir, headFile))
+	switch {
+	case err == nil:
+		s.first, err = strconv.ParseUint(strings.TrimSpace(string(head)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("corrupt %s file: %w", headFile, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if len(s.segments) > 0 {
+			s.first = s.segments[0].base
+		}
+	default:
+		return err
+	}
+
+	s.next = s.first
+	if len(s.segments) > 0 {
+		last := s.segments[len(s.segments)-1]
+		if last.next >= s.next {
+			s.next = last.next
+			s.active, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644)
+			return err
+		}
+	}
+	return s.roll()
+}
+
+// roll closes the active segment and starts a new one at the next offset.
+func (s *FileStore) roll() error {
+	if s.active != nil {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+	}
+
+	seg := &segment{
+		base: s.next,
+		next: s.next,
+		path: filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.next, segmentExt)),
+	}
+	file, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	s.active = file
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+func (s *FileStore) Append(record *Record) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return 0, fmt.Errorf("pubsub: append to store: %w", os.ErrClosed)
+	}
+	seg := s.segments[len(s.segments)-1]
+	if seg.size >= s.opt.SegmentSize && seg.next > seg.base {
+		if err := s.roll(); err != nil {
+			return 0, fmt.Errorf("pubsub: append to store: %w", err)
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+
+	stored := *record
+	stored.Offset = s.next
+	frame, err := encodeFrame(&stored)
+	if err != nil {
+		return 0, fmt.Errorf("pubsub: append to store: %w", err)
+	}
+	if _, err := s.active.Write(frame); err != nil {
+		return 0, fmt.Errorf("pubsub: append to store: %w", err)
+	}
+	seg.track(stored.Offset, seg.size)
+	seg.size += int64(len(frame))
+	seg.next++
+	s.next++
+
+	if err := s.sync(s.active, &s.dirty); err != nil {
+		return 0, fmt.Errorf("pubsub: append to store: %w", err)
+	}
+	return stored.Offset, nil
+}
+
+// sync flushes the file appended to according to the sync policy, or marks
+// it dirty for the next flush.
+func (s *FileStore) sync(file *os.File, dirty *bool) error {
+	switch s.opt.Sync {
+	case SyncAlways:
+		return file.Sync()
+	case SyncInterval:
+		*dirty = true
+	}
+	return nil
+}
+
+// flushEvery flushes the records appended since the last flush every
+// SyncInterval, until the store is closed.
+func (s *FileStore) flushEvery() {
+	ticker := time.NewTicker(s.opt.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		s.mutex.Lock()
+		if s.dirty && !s.closed {
+			if err := s.active.Sync(); err != nil {
+				log.Printf("pubsub: sync store: %v\n", err)
+			} else {
+				s.dirty = false
+			}
+		}
+		if s.scheduled.dirty && !s.closed {
+			if err := s.scheduled.file.Sync(); err != nil {
+				log.Printf("pubsub: sync scheduled messages: %v\n", err)
+			} else {
+				s.scheduled.dirty = false
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (s *FileStore) Read(offset uint64, limit int) ([]*Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	offset = max(offset, s.first)
+	var records []*Record
+	for _, seg := range s.segments {
+		if seg.next <= offset {
+			continue
+		}
+		_, _, err := readFrames(seg.path, seg.seek(offset), func(record *Record, pos int64) bool {
+			if record.Offset >= offset {
+				records = append(records, record)
+			}
+			return limit <= 0 || len(records) < limit
+		})
+		if err != nil {
+			return nil, fmt.Errorf("pubsub: read store: %w", err)
+		}
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+func (s *FileStore) Truncate(offset uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	offset = min(offset, s.next)
+	if offset <= s.first {
+		return nil
+	}
+	if err := s.writeHead(offset); err != nil {
+		return fmt.Errorf("pubsub: truncate store: %w", err)
+	}
+	s.first = offset
+
+	// The active segment is kept even when all its records are removed.
+	for len(s.segments) > 1 && s.segments[0].next <= offset {
+		if err := os.Remove(s.segments[0].path); err != nil {
+			return fmt.Errorf("pubsub: truncate store: %w", err)
+		}
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+// writeHead saves the first offset of the log in the HEAD file.
+func (s *FileStore) writeHead(offset uint64) error {
+	return s.replaceFile(headFile, []byte(strconv.FormatUint(offset, 10)))
+}
+
+// replaceFile replaces the content of the given file of the store
+// atomically. The new content is flushed before the file is renamed, and the
+// directory after, so a crash leaves either the old or the new content.
+func (s *FileStore) replaceFile(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return s.syncDir()
+}
+
+// syncDir flushes the directory of the store, so the files renamed in it
+// survive a crash.
+func (s *FileStore) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// Compact rewrites the segments holding records to drop, and deletes the
+// segments left without records. The active segment is never rewritten, so
+// drop is not called for its records.
+func (s *FileStore) Compact(drop func(record *Record) bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("pubsub: compact store: %w", os.ErrClosed)
+	}
+	last := len(s.segments) - 1
+	kept := make([]*segment, 0, len(s.segments))
+	for i, seg := range s.segments[:last] {
+		deleted, err := s.rewrite(seg, drop)
+		if err != nil {
+			s.segments = append(kept, s.segments[i:]...)
+			return fmt.Errorf("pubsub: compact store: %w", err)
+		}
+		if !deleted {
+			kept = append(kept, seg)
+		}
+	}
+	s.segments = append(kept, s.segments[last])
+	return nil
+}
+
+// rewrite removes the records to drop, and the truncated ones, from the
+// sealed segment. It deletes the segment when no record is left, and reports
+// whether it did.
+func (s *FileStore) rewrite(seg *segment, drop func(record *Record) bool) (bool, error) {
+	var records []*Record
+	dropped := false
+	_, _, err := readFrames(seg.path, 0, func(record *Record, pos int64) bool {
+		if record.Offset < s.first || drop(record) {
+			dropped = true
+		} else {
+			records = append(records, record)
+		}
+		return true
+	})
+	if err != nil || !dropped {
+		return false, err
+	}
+	if len(records) == 0 {
+		return true, os.Remove(seg.path)
+	}
+
+	tmp := seg.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return false, err
+	}
+	writer := bufio.NewWriter(file)
+	rewritten := &segment{}
+	for _, record := range records {
+		frame, err := encodeFrame(record)
+		if err == nil {
+			_, err = writer.Write(frame)
+		}
+		if err != nil {
+			file.Close()
+			return false, err
+		}
+		rewritten.track(record.Offset, rewritten.size)
+		rewritten.size += int64(len(frame))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, seg.path); err != nil {
+		return false, err
+	}
+	if err := s.syncDir(); err != nil {
+		return false, err
+	}
+	seg.size, seg.index = rewritten.size, rewritten.index
+	return false, nil
+}
+
+func (s *FileStore) SaveCheckpoints(checkpoints map[string]Checkpoint) error {
+	data, err := json.Marshal(checkpoints)
+	if err != nil {
+		return fmt.Errorf("pubsub: save checkpoints: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.replaceFile(checkpointFile, data); err != nil {
+		return fmt.Errorf("pubsub: save checkpoints: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) LoadCheckpoints() (map[string]Checkpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	checkpoints := map[string]Checkpoint{}
+	data, err := os.ReadFile(filepath.Join(s.dir, checkpointFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoints, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &checkpoints)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: load checkpoints: %w", err)
+	}
+	return checkpoints, nil
+}
+
+func (s *FileStore) AddScheduled(record *ScheduledRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.appendScheduled(&scheduledEntry{Add: record}); err != nil {
+		return fmt.Errorf("pubsub: add scheduled message: %w", err)
+	}
+	s.scheduled.ids[record.ID] = true
+	return nil
+}
+
+func (s *FileStore) RemoveScheduled(ids ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var removed []string
+	for _, id := range ids {
+		if s.scheduled.ids[id] {
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := s.appendScheduled(&scheduledEntry{Remove: removed}); err != nil {
+		return fmt.Errorf("pubsub: remove scheduled messages: %w", err)
+	}
+	for _, id := range removed {
+		delete(s.scheduled.ids, id)
+	}
+
+	if s.scheduled.entries >= scheduledCompactMin && s.scheduled.entries > 2*len(s.scheduled.ids) {
+		if err := s.rewriteScheduled(); err != nil {
+			return fmt.Errorf("pubsub: compact scheduled messages: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) LoadScheduled() ([]*ScheduledRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records, _, err := s.replayScheduled()
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: load scheduled messages: %w", err)
+	}
+	return records, nil
+}
+
+// appendScheduled appends the entry to the SCHEDULED log.
+func (s *FileStore) appendScheduled(entry *scheduledEntry) error {
+	if s.closed {
+		return os.ErrClosed
+	}
+	if s.scheduled.file == nil {
+		file, err := os.OpenFile(filepath.Join(s.dir, scheduledFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		s.scheduled.file = file
+	}
+
+	frame, err := encodeFrame(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.scheduled.file.Write(frame); err != nil {
+		return err
+	}
+	s.scheduled.entries++
+	return s.sync(s.scheduled.file, &s.scheduled.dirty)
+}
+
+// replayScheduled reads the SCHEDULED log and returns the messages left, in
+// the order they were added, and the number of entries of the log. A torn
+// entry at the end of the log is cut off.
+func (s *FileStore) replayScheduled() ([]*ScheduledRecord, int, error) {
+	path := filepath.Join(s.dir, scheduledFile)
+	var added []*ScheduledRecord
+	saved := map[string]*ScheduledRecord{}
+	entries := 0
+	valid, torn, err := readFrames(path, 0, func(entry *scheduledEntry, pos int64) bool {
+		entries++
+		if entry.Add != nil {
+			added = append(added, entry.Add)
+			saved[entry.Add.ID] = entry.Add
+		}
+		for _, id := range entry.Remove {
+			delete(saved, id)
+		}
+		return true
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if torn {
+		if err := os.Truncate(path, valid); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// A message added again replaces the previous one.
+	records := slices.DeleteFunc(added, func(record *ScheduledRecord) bool {
+		return saved[record.ID] != record
+	})
+	return records, entries, nil
+}
+
+// rewriteScheduled replaces the SCHEDULED log with the messages left.
+func (s *FileStore) rewriteScheduled() error {
+	records, _, err := s.replayScheduled()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, record := range records {
+		frame, err := encodeFrame(&scheduledEntry{Add: record})
+		if err != nil {
+			return err
+		}
+		data = append(data, frame...)
+	}
+
+	if err := s.scheduled.file.Close(); err != nil {
+		return err
+	}
+	s.scheduled.file = nil
+	s.scheduled.dirty = false
+	if err := s.replaceFile(scheduledFile, data); err != nil {
+		return err
+	}
+	s.scheduled.entries = len(records)
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.scheduled.file != nil {
+		if err := s.scheduled.file.Sync(); err != nil {
+			s.scheduled.file.Close()
+			s.active.Close()
+			return fmt.Errorf("pubsub: close store: %w", err)
+		}
+		if err := s.scheduled.file.Close(); err != nil {
+			s.active.Close()
+			return fmt.Errorf("pubsub: close store: %w", err)
+		}
+	}
+	if err := s.active.Sync(); err != nil {
+		s.active.Close()
+		return fmt.Errorf("pubsub: close store: %w", err)
+	}
+	return s.active.Close()
+}
+
+// encodeFrame returns the record, or the entry of the SCHEDULED log, framed
+// by its length and checksum.
+func encodeFrame(value any) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, frameHeader+len(data))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[frameHeader:], data)
+	return frame, nil
+}
+
+// readFrames calls visit with the records of the segment file, or the
+// entries of the SCHEDULED log, and their position in order, starting at the
+// given position, until visit returns false. It returns the position after
+// the valid records read, and reports whether the file ends with a torn or
+// corrupt record.
+func readFrames[T any](path string, from int64, visit func(record *T, pos int64) bool) (int64, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := file.Seek(from, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, frameHeader)
+	valid := from
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return valid, false, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return valid, true, nil
+			}
+			return valid, false, err
+		}
+		// A length beyond the end of the file is a torn or corrupt header,
+		// not a reason to allocate it.
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		if length > info.Size()-valid-frameHeader {
+			return valid, true, nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return valid, true, nil
+			}
+			return valid, false, err
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			return valid, true, nil
+		}
+		record := new(T)
+		if err := json.Unmarshal(data, record); err != nil {
+			return valid, true, nil
+		}
+		pos := valid
+		valid += int64(frameHeader + len(data))
+		if !visit(record, pos) {
+			return valid, false, nil
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+type GatherOptions struct {
+	// the maximum number of replies to collect, zero collects a reply from
+	// every responder
+	Max int
+	// the number of replies after which Gather returns without waiting for
+	// the other responders, zero waits for every responder
+	Quorum int
+	// how long to wait for replies, zero waits until the context is done
+	Timeout time.Duration
+}
+
+// Gather publishes the payload to the specified topic as a request, like
+// Request, and collects the replies of the responders.
+//
+// The number of expected responders is looked up in the topic index of the
+// broker when the request is published: every subscriber of a matching topic,
+// pattern or predicate, and one member of each consumer group. Gather returns
+// as soon as every responder replied, Max replies arrived or the Quorum is
+// met. Otherwise it returns the replies received when the Timeout elapses, or
+// with the error of the context when the context is done first. When a quorum
+// is set and fewer replies arrived, including when there are fewer responders
+// than the quorum, the replies are returned with ErrQuorumNotMet.
+//
+// Replies carrying an error in the ErrorHeader are collected like the others.
+// Gather returns ErrNoResponders when the topic has no subscribers, and the
+// errors of TryAddSubscriber and PublishWithOptions.
+func (b *Broker) Gather(ctx context.Context, topic string, payload any, opt GatherOptions, opts ...PublishOption) ([]*Message, error) {
+	inbox, err := b.newInbox()
+	if err != nil {
+		return nil, err
+	}
+	defer b.RemoveSubscriber(inbox.sub)
+
+	opts = append(opts, WithHeader(ReplyToHeader, inbox.topic))
+	result, err := b.PublishWithOptions(topic, payload, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if result.Delivered == 0 {
+		return nil, ErrNoResponders
+	}
+
+	want := result.Delivered
+	if opt.Max > 0 {
+		want = min(want, opt.Max)
+	}
+	if opt.Quorum > 0 {
+		want = min(want, opt.Quorum)
+	}
+
+	var expired <-chan time.Time
+	if opt.Timeout > 0 {
+		timer := time.NewTimer(opt.Timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	replies := []*Message{}
+	for len(replies) < want {
+		select {
+		case reply, ok := <-inbox.sub.GetMessages():
+			if !ok {
+				return replies, ErrBrokerClosed
+			}
+			reply.Ack()
+			replies = append(replies, reply)
+		case <-expired:
+			return replies, quorum(replies, opt)
+		case <-ctx.Done():
+			return replies, ctx.Err()
+		}
+	}
+	return replies, quorum(replies, opt)
+}
+
+// quorum returns ErrQuorumNotMet when fewer replies than the quorum were
+// collected.
+func quorum(replies []*Message, opt GatherOptions) error {
+	if len(replies) < opt.Quorum {
+		return ErrQuorumNotMet
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package pubsub_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+func Test_Gather(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	for i := 1; i <= 3; i++ {
+		pubsub.NewHandler(module).Respond("prices", func(msg *pubsub.Message) (any, error) {
+			return fmt.Sprintf("%s:%d", msg.GetContent(), i), nil
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	replies, err := broker.Gather(ctx, "prices", "BTC", pubsub.GatherOptions{})
+	require.Nil(t, err)
+	contents := []string{}
+	for _, reply := range replies {
+		contents = append(contents, reply.GetContent().(string))
+	}
+	sort.Strings(contents)
+	require.Equal(t, []string{"BTC:1", "BTC:2", "BTC:3"}, contents)
+
+	replies, err = broker.Gather(ctx, "prices", "ETH", pubsub.GatherOptions{Max: 2})
+	require.Nil(t, err)
+	require.Len(t, replies, 2)
+
+	replies, err = broker.Gather(ctx, "prices", "ETH", pubsub.GatherOptions{Quorum: 1})
+	require.Nil(t, err)
+	require.Len(t, replies, 1)
+
+	_, err = broker.Gather(ctx, "orders", "ETH", pubsub.GatherOptions{})
+	require.ErrorIs(t, err, pubsub.ErrNoResponders)
+}
+
+func Test_GatherTimeout(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	pubsub.NewHandler(module).Respond("prices", func(msg *pubsub.Message) (any, error) {
+		return "fast", nil
+	})
+	silent := broker.AddSubscriber()
+	broker.Subscribe(silent, "prices")
+
+	replies, err := broker.Gather(context.Background(), "prices", "BTC", pubsub.GatherOptions{
+		Timeout: 50 * time.Millisecond,
+	})
+	require.Nil(t, err)
+	require.Len(t, replies, 1)
+	require.Equal(t, "fast", replies[0].GetContent())
+
+	replies, err = broker.Gather(context.Background(), "prices", "BTC", pubsub.GatherOptions{
+		Quorum:  2,
+		Timeout: 50 * time.Millisecond,
+	})
+	require.ErrorIs(t, err, pubsub.ErrQuorumNotMet)
+	require.Len(t, replies, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	replies, err = broker.Gather(ctx, "prices", "BTC", pubsub.GatherOptions{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, replies, 1)
+
+	// A quorum larger than the number of responders cannot be met.
+	broker.RemoveSubscriber(silent)
+	replies, err = broker.Gather(context.Background(), "prices", "BTC", pubsub.GatherOptions{
+		Quorum:  3,
+		Timeout: 50 * time.Millisecond,
+	})
+	require.ErrorIs(t, err, pubsub.ErrQuorumNotMet)
+	require.Len(t, replies, 1)
+}
+
+func Test_GatherGroup(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	for range 2 {
+		handler := pubsub.NewHandler(module)
+		handler.ListenWithOptions(func(msg *pubsub.Message) error {
+			return msg.Reply("member")
+		}, pubsub.ListenOptions{Topics: []string{"prices"}, Group: "quotes"})
+	}
+	pubsub.NewHandler(module).Respond("prices", func(msg *pubsub.Message) (any, error) {
+		return "single", nil
+	})
+
+	// The group counts as one responder, so Gather does not wait for the
+	// timeout.
+	start := time.Now()
+	replies, err := broker.Gather(context.Background(), "prices", "BTC", pubsub.GatherOptions{
+		Timeout: time.Second,
+	})
+	require.Nil(t, err)
+	require.Len(t, replies, 2)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
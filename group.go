@@ -0,0 +1,279 @@
+package pubsub
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer picks the member of a consumer group that receives a message.
+//
+// Each group owns its balancer. Rebalance is called with the current members
+// every time a member joins or leaves the group, and Pick may be called
+// concurrently by publishers.
+type Balancer interface {
+	// Rebalance replaces the members the balancer picks from.
+	Rebalance(members []*Subscriber)
+	// Pick returns the member that receives the message, or nil when the
+	// group has no members.
+	Pick(msg *Message) *Subscriber
+}
+
+type group struct {
+	name     string
+	members  []*Subscriber
+	balancer Balancer
+}
+
+// SubscribeGroup adds the subscriber to the consumer group of the specified
+// topic.
+//
+// Every message published to the topic is delivered to exactly one member of
+// each group, chosen by the balancer of the group. The balancer is created by
+// BrokerOptions.Balancer and defaults to RoundRobin. When a member leaves the
+// group, by Unsubscribe or RemoveSubscriber, the remaining members are
+// rebalanced. With BrokerOptions.AtLeastOnce, the messages the member did not
+// acknowledge are redelivered to the remaining members.
+//
+// A subscriber joining a group stops receiving every message of the topic
+// on its own. Members joining a group do not receive the retained messages of
+// the topic.
+func (b *Broker) SubscribeGroup(s *Subscriber, topic string, name string) {
+	_ = b.TrySubscribeGroup(s, topic, name)
+}
+
+// TrySubscribeGroup adds the subscriber to the consumer group of the specified
+// topic, or returns the same errors as TrySubscribe.
+func (b *Broker) TrySubscribeGroup(s *Subscriber, topic string, name string) error {
+	if err := b.checkSubscription(s, topic); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.indexed(topic) && b.trie != nil {
+		b.trie.insert(topic)
+	}
+	if subscribers, ok := b.topics[topic]; ok {
+		delete(subscribers, s.ID)
+		if len(subscribers) == 0 {
+			delete(b.topics, topic)
+		}
+	}
+	b.leaveGroup(s, topic)
+
+	if b.groups[topic] == nil {
+		b.groups[topic] = map[string]*group{}
+	}
+	g := b.groups[topic][name]
+	if g == nil {
+		g = &group{name: name, balancer: b.newBalancer()}
+		b.groups[topic][name] = g
+	}
+	g.members = append(g.members, s)
+	g.balancer.Rebalance(slices.Clone(g.members))
+	s.joinGroup(topic, name)
+	return nil
+}
+
+// GetGroupMembers returns the number of members of the consumer group of the
+// given topic.
+func (b *Broker) GetGroupMembers(topic string, name string) int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if g := b.groups[topic][name]; g != nil {
+		return len(g.members)
+	}
+	return 0
+}
+
+func (b *Broker) newBalancer() Balancer {
+	if b.opt.Balancer != nil {
+		return b.opt.Balancer()
+	}
+	return RoundRobin()
+}
+
+// leaveGroup removes the subscriber from the consumer group it joined for the
+// given topic and rebalances the group. The caller must hold the mutex.
+func (b *Broker) leaveGroup(s *Subscriber, topic string) {
+	name := s.GetGroup(topic)
+	g := b.groups[topic][name]
+	if g == nil {
+		return
+	}
+
+	g.members = slices.DeleteFunc(g.members, func(member *Subscriber) bool {
+		return member.ID == s.ID
+	})
+	g.balancer.Rebalance(slices.Clone(g.members))
+	if len(g.members) == 0 {
+		delete(b.groups[topic], name)
+		if len(b.groups[topic]) == 0 {
+			delete(b.groups, topic)
+		}
+	}
+	s.RemoveTopic(topic)
+}
+
+type roundRobin struct {
+	mutex   sync.RWMutex
+	members []*Subscriber
+	next    atomic.Uint64
+}
+
+// RoundRobin returns a balancer that hands messages to the members of a group
+// in turn.
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+func (r *roundRobin) Rebalance(members []*Subscriber) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.members = members
+}
+
+func (r *roundRobin) Pick(msg *Message) *Subscriber {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.members) == 0 {
+		return nil
+	}
+	n := r.next.Add(1) - 1
+	return r.members[n%uint64(len(r.members))]
+}
+
+type random struct {
+	mutex   sync.RWMutex
+	members []*Subscriber
+}
+
+// Random returns a balancer that hands each message to a randomly chosen
+// member of a group.
+func Random() Balancer {
+	return &random{}
+}
+
+func (r *random) Rebalance(members []*Subscriber) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.members = members
+}
+
+func (r *random) Pick(msg *Message) *Subscriber {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.members) == 0 {
+		return nil
+	}
+	return r.members[rand.IntN(len(r.members))]
+}
+
+type leastPending struct {
+	mutex   sync.RWMutex
+	members []*Subscriber
+}
+
+// LeastPending returns a balancer that hands each message to the member of a
+// group with the fewest pending messages.
+func LeastPending() Balancer {
+	return &leastPending{}
+}
+
+func (l *leastPending) Rebalance(members []*Subscriber) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.members = members
+}
+
+func (l *leastPending) Pick(msg *Message) *Subscriber {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	var picked *Subscriber
+	pending := 0
+	for _, member := range l.members {
+		if n := member.Pending(); picked == nil || n < pending {
+			picked, pending = member, n
+		}
+	}
+	return picked
+}
+
+// consistentHashReplicas is the number of points each member owns on the
+// hash ring.
+const consistentHashReplicas = 64
+
+type consistentHash struct {
+	mutex  sync.RWMutex
+	key    func(msg *Message) string
+	points []uint64
+	owners map[uint64]*Subscriber
+}
+
+// ConsistentHash returns a balancer that hands messages with the same key to
+// the same member of a group. Members are placed on a hash ring, so when a
+// member leaves only the keys it owned move to other members.
+//
+// The key function extracts the key of a message. When it is nil, the key
+// given with WithKey is used, or the content of the message formatted with
+// fmt.Sprint for messages published without a key.
+func ConsistentHash(key func(msg *Message) string) Balancer {
+	if key == nil {
+		key = func(msg *Message) string {
+			if k := msg.GetKey(); k != "" {
+				return k
+			}
+			return fmt.Sprint(msg.GetContent())
+		}
+	}
+	return &consistentHash{key: key}
+}
+
+func (c *consistentHash) Rebalance(members []*Subscriber) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.points = c.points[:0]
+	c.owners = map[uint64]*Subscriber{}
+	for _, member := range members {
+		for i := range consistentHashReplicas {
+			point := hashKey(fmt.Sprintf("%s#%d", member.ID, i))
+			c.points = append(c.points, point)
+			c.owners[point] = member
+		}
+	}
+	slices.Sort(c.points)
+}
+
+func (c *consistentHash) Pick(msg *Message) *Subscriber {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if len(c.points) == 0 {
+		return nil
+	}
+	point := hashKey(c.key(msg))
+	i := sort.Search(len(c.points), func(i int) bool {
+		return c.points[i] >= point
+	})
+	if i == len(c.points) {
+		i = 0
+	}
+	return c.owners[c.points[i]]
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
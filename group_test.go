@@ -0,0 +1,173 @@
+package pubsub_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_GroupRoundRobin(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	var members []*pubsub.Subscriber
+	for range 3 {
+		sub := broker.AddSubscriber()
+		broker.SubscribeGroup(sub, "jobs", "workers")
+		members = append(members, sub)
+	}
+	audit := broker.AddSubscriber()
+	broker.Subscribe(audit, "jobs")
+
+	require.Equal(t, 3, broker.GetGroupMembers("jobs", "workers"))
+	require.Equal(t, 4, broker.GetSubscribers("jobs"))
+	require.Equal(t, "workers", members[0].GetGroup("jobs"))
+	require.Equal(t, []string{"jobs"}, members[0].GetTopic())
+
+	for i := range 6 {
+		broker.Publish("jobs", i)
+	}
+	for _, member := range members {
+		require.Len(t, drain(member), 2)
+	}
+	require.Len(t, drain(audit), 6)
+
+	broker.RemoveSubscriber(members[0])
+	require.Equal(t, 2, broker.GetGroupMembers("jobs", "workers"))
+	for i := range 4 {
+		broker.Publish("jobs", i)
+	}
+	require.Len(t, drain(members[1]), 2)
+	require.Len(t, drain(members[2]), 2)
+
+	broker.Unsubscribe(members[1], "jobs")
+	broker.Unsubscribe(members[2], "jobs")
+	require.Equal(t, 0, broker.GetGroupMembers("jobs", "workers"))
+	require.Equal(t, 1, broker.GetSubscribers("jobs"))
+}
+
+func Test_GroupConsistentHash(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		Balancer: func() pubsub.Balancer {
+			return pubsub.ConsistentHash(nil)
+		},
+	})
+
+	var members []*pubsub.Subscriber
+	for range 4 {
+		sub := broker.AddSubscriber()
+		broker.SubscribeGroup(sub, "accounts", "ledger")
+		members = append(members, sub)
+	}
+
+	owner := func(key string) *pubsub.Subscriber {
+		broker.Publish("accounts", key)
+		for _, member := range members {
+			if contents := drain(member); len(contents) > 0 {
+				require.Equal(t, []any{key}, contents)
+				return member
+			}
+		}
+		return nil
+	}
+
+	owners := map[string]*pubsub.Subscriber{}
+	for i := range 8 {
+		key := fmt.Sprintf("account-%d", i)
+		owners[key] = owner(key)
+		require.Same(t, owners[key], owner(key))
+	}
+
+	broker.RemoveSubscriber(members[0])
+	members = members[1:]
+	for key, previous := range owners {
+		current := owner(key)
+		require.NotNil(t, current)
+		if previous.IsActive() {
+			require.Same(t, previous, current)
+		}
+	}
+}
+
+func Test_GroupLeastPending(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		Delivery: pubsub.DeliveryConcurrent,
+		Balancer: pubsub.LeastPending,
+	})
+
+	busy := broker.AddSubscriber()
+	idle := broker.AddSubscriber()
+	busy.Signal(pubsub.NewMessage("other", 1))
+	broker.SubscribeGroup(busy, "jobs", "workers")
+	broker.SubscribeGroup(idle, "jobs", "workers")
+
+	broker.Publish("jobs", "job")
+	require.Equal(t, []any{"job"}, drain(idle))
+	require.Equal(t, []any{1}, drain(busy))
+}
+
+func Test_GroupRandom(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		Balancer: pubsub.Random,
+	})
+
+	a := broker.AddSubscriber()
+	b := broker.AddSubscriber()
+	broker.SubscribeGroup(a, "jobs", "workers")
+	broker.SubscribeGroup(b, "jobs", "workers")
+
+	for i := range 10 {
+		broker.Publish("jobs", i)
+	}
+	require.Len(t, append(drain(a), drain(b)...), 10)
+}
+
+func Test_GroupRedeliver(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{AtLeastOnce: true})
+
+	leaving := broker.AddSubscriber()
+	broker.SubscribeGroup(leaving, "jobs", "workers")
+	staying := broker.AddSubscriber()
+	broker.SubscribeGroup(staying, "jobs", "workers")
+
+	for i := range 4 {
+		broker.Publish("jobs", i)
+	}
+	require.Equal(t, []any{1, 3}, drain(staying))
+
+	// The unacknowledged messages of a member leaving the group go to the
+	// remaining members.
+	broker.RemoveSubscriber(leaving)
+	require.ElementsMatch(t, []any{0, 2}, drain(staying))
+	require.Equal(t, 4, broker.Unacked())
+}
+
+func Test_GroupConsistentHashKey(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		Balancer: func() pubsub.Balancer {
+			return pubsub.ConsistentHash(nil)
+		},
+	})
+
+	var members []*pubsub.Subscriber
+	for range 4 {
+		sub := broker.AddSubscriber()
+		broker.SubscribeGroup(sub, "accounts", "ledger")
+		members = append(members, sub)
+	}
+
+	// Messages published with the same key go to the same member, whatever
+	// their content.
+	for i := range 16 {
+		broker.PublishWithOptions("accounts", i, pubsub.WithKey("account-1"))
+	}
+	received := 0
+	for _, member := range members {
+		if contents := drain(member); len(contents) > 0 {
+			require.Len(t, contents, 16)
+			received++
+		}
+	}
+	require.Equal(t, 1, received)
+}
@@ -1,10 +1,33 @@
 package pubsub
 
-import "github.com/tinh-tinh/tinhtinh/v2/core"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+const (
+	// DefaultMinBackoff is the delay before the first retry of a failed
+	// message, when no backoff is configured.
+	DefaultMinBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff is the maximum delay between retries of a failed
+	// message, when no backoff is configured.
+	DefaultMaxBackoff = 10 * time.Second
+)
 
 type Handler struct {
 	core.DynamicProvider
-	module core.Module
+	module  core.Module
+	mutex   sync.Mutex
+	running int           // Messages being handled
+	drained chan struct{} // Closed when running drops to zero
 }
 
 func NewHandler(module core.Module) *Handler {
@@ -15,23 +38,264 @@ func NewHandler(module core.Module) *Handler {
 
 type HandleFnc func(sub *Message)
 
+// HandleErrFnc handles a message and reports a failure by returning an error.
+type HandleErrFnc func(msg *Message) error
+
+type ListenOptions struct {
+	// the topics to subscribe to
+	Topics []string
+	// the consumer group to join on the topics, empty receives every message
+	Group string
+	// how many times a failed message is retried before it is rejected
+	Retries int
+	// the delay before the first retry, defaults to DefaultMinBackoff
+	MinBackoff time.Duration
+	// the maximum delay between retries, defaults to DefaultMaxBackoff
+	MaxBackoff time.Duration
+	// the fraction of each delay that is randomized, between 0 and 1
+	Jitter float64
+	// called when a message still fails after all retries, defaults to
+	// logging the error
+	OnError func(msg *Message, err error)
+	// the number of workers handling messages in parallel, defaults to 1
+	Concurrency int
+	// returns the ordering key of a message, messages with the same key are
+	// handled one after another by the same worker
+	Key func(msg *Message) string
+	// set this to `true` to handle waiting messages by decreasing priority,
+	// see WithPriority
+	Priority bool
+}
+
+// backoff returns the delay before the given retry, starting at 0. The delay
+// doubles with every retry up to MaxBackoff, then up to Jitter of it is
+// randomly taken off.
+func (opt ListenOptions) backoff(retry int) time.Duration {
+	delay := opt.MinBackoff
+	for i := 0; i < retry && delay < opt.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, opt.MaxBackoff)
+	if opt.Jitter > 0 {
+		delay -= time.Duration(float64(delay) * min(opt.Jitter, 1) * rand.Float64())
+	}
+	return delay
+}
+
+// PanicError is the error a handler fails with when it panics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("pubsub: handler panic: %v", e.Value)
+}
+
+// Listen subscribes the handler to the topics and calls factory with every
+// message received, until the subscriber is removed from the broker.
+//
+// The message is acknowledged when factory returns. A panic in factory is
+// recovered and rejects the message. Listen panics when the handler cannot
+// subscribe; use TryListen to get the error instead.
 func (h *Handler) Listen(factory HandleFnc, topics ...string) {
+	if err := h.TryListen(factory, topics...); err != nil {
+		panic(err)
+	}
+}
+
+// TryListen works like Listen, but returns the error that prevented the
+// handler from subscribing to the topics.
+func (h *Handler) TryListen(factory HandleFnc, topics ...string) error {
+	return h.TryListenWithOptions(func(msg *Message) error {
+		factory(msg)
+		return nil
+	}, ListenOptions{Topics: topics})
+}
+
+// ListenGroup works like Listen, but the handler joins the given consumer
+// group on the topics. Several handlers listening with the same group share
+// the messages: each message is handled by only one of them.
+func (h *Handler) ListenGroup(factory HandleFnc, group string, topics ...string) {
+	h.ListenWithOptions(func(msg *Message) error {
+		factory(msg)
+		return nil
+	}, ListenOptions{Topics: topics, Group: group})
+}
+
+// ListenWithOptions subscribes the handler to the topics of the options and
+// calls factory with every message received, until the subscriber is removed
+// from the broker.
+//
+// Messages are handled by Concurrency workers. When Key is set, messages with
+// the same key always go to the same worker, so they are handled in order
+// while messages with different keys are handled in parallel.
+//
+// When factory returns an error or panics, the message is retried up to
+// Retries times with an exponential backoff. A message that succeeds is
+// acknowledged; a message that still fails is reported to OnError and, with
+// AtLeastOnce, requeued after the next backoff delay until the MaxDeliveries
+// of the dead-letter policy sends it to the dead-letter topic. A message of
+// the wrong type is rejected without requeue.
+//
+// Unless the broker sets a BlockTimeout, publishers wait for the handler to
+// make room in its buffer rather than drop its messages.
+func (h *Handler) ListenWithOptions(factory HandleErrFnc, opt ListenOptions) {
+	if err := h.TryListenWithOptions(factory, opt); err != nil {
+		panic(err)
+	}
+}
+
+// TryListenWithOptions works like ListenWithOptions, but returns the error
+// that prevented the handler from subscribing to the topics:
+// ErrBrokerNotFound when the module has no broker, or the errors of
+// TryAddSubscriber and TrySubscribe.
+func (h *Handler) TryListenWithOptions(factory HandleErrFnc, opt ListenOptions) error {
 	broken := InjectBroker(h.module)
 	if broken == nil {
-		panic("broken not defined")
+		return ErrBrokerNotFound
+	}
+	if opt.MinBackoff <= 0 {
+		opt.MinBackoff = DefaultMinBackoff
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = DefaultMaxBackoff
 	}
-	sub := broken.AddSubscriber()
-	if len(topics) > 0 {
-		for _, topic := range topics {
-			broken.Subscribe(sub, topic)
 
+	subOpt := SubscriberOptions{Priority: opt.Priority}
+	if broken.opt.BlockTimeout == 0 {
+		subOpt.BlockTimeout = -1
+	}
+	sub, err := broken.TryAddSubscriber(subOpt)
+	if err != nil {
+		return err
+	}
+	for _, topic := range opt.Topics {
+		if opt.Group != "" {
+			err = broken.TrySubscribeGroup(sub, topic, opt.Group)
+		} else {
+			err = broken.TrySubscribe(sub, topic)
+		}
+		if err != nil {
+			broken.RemoveSubscriber(sub)
+			return err
 		}
 	}
 
+	workers := make([]chan *Message, max(opt.Concurrency, 1))
+	for i := range workers {
+		if i > 0 && opt.Key == nil {
+			// Without ordering keys, all workers share one channel.
+			workers[i] = workers[0]
+		} else {
+			workers[i] = make(chan *Message)
+		}
+		go (func(messages chan *Message) {
+			for msg := range messages {
+				process(factory, msg, opt)
+				h.done()
+			}
+		})(workers[i])
+	}
+
 	go (func(sub *Subscriber) {
-		msg, ok := <-sub.GetMessages()
-		if ok {
-			factory(msg)
+		for msg := range sub.GetMessages() {
+			// The message may have expired while buffered in the channel.
+			if msg.IsExpired() {
+				sub.expire(msg)
+				continue
+			}
+			worker := 0
+			if opt.Key != nil {
+				worker = int(hashKey(opt.Key(msg)) % uint64(len(workers)))
+			}
+			h.start()
+			workers[worker] <- msg
+		}
+		closed := map[chan *Message]bool{}
+		for _, worker := range workers {
+			if !closed[worker] {
+				closed[worker] = true
+				close(worker)
+			}
 		}
 	})(sub)
+	return nil
+}
+
+// start counts a message being handled.
+func (h *Handler) start() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.running == 0 {
+		h.drained = make(chan struct{})
+	}
+	h.running++
+}
+
+// done counts a handled message.
+func (h *Handler) done() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.running--
+	if h.running == 0 {
+		close(h.drained)
+	}
+}
+
+// Drain waits until the messages the handler has received are handled, or
+// until the context is done, in which case the error of the context is
+// returned.
+func (h *Handler) Drain(ctx context.Context) error {
+	h.mutex.Lock()
+	if h.running == 0 {
+		h.mutex.Unlock()
+		return nil
+	}
+	drained := h.drained
+	h.mutex.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// process handles the message with retries, then acknowledges or rejects it.
+func process(factory HandleErrFnc, msg *Message, opt ListenOptions) {
+	err := call(factory, msg)
+	// A message of the wrong type fails the same way on every retry.
+	for retry := 0; err != nil && !errors.Is(err, ErrTypeMismatch) && retry < opt.Retries; retry++ {
+		time.Sleep(opt.backoff(retry))
+		err = call(factory, msg)
+	}
+	if err == nil {
+		msg.Ack()
+		return
+	}
+
+	// A message of the wrong type is rejected for good, others are requeued
+	// after a growing backoff until the dead-letter policy gives up on them.
+	delay := opt.backoff(opt.Retries + max(msg.GetAttempts()-1, 0))
+	msg.fail(!errors.Is(err, ErrTypeMismatch), delay, err.Error())
+	if opt.OnError != nil {
+		opt.OnError(msg, err)
+	} else {
+		log.Printf("pubsub: handling message from topic %s failed: %v\n", msg.GetTopic(), err)
+	}
+}
+
+// call runs the handler, turning a panic into a PanicError.
+func call(factory HandleErrFnc, msg *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	return factory(msg)
 }
@@ -1,11 +1,16 @@
 package pubsub_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/tinh-tinh/pubsub/v2"
@@ -108,3 +113,241 @@ func Test_Handler(t *testing.T) {
 
 	require.Equal(t, "hihi", response.Data)
 }
+
+func Test_HandlerContinuous(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	received := make(chan any, 10)
+	handler := pubsub.NewHandler(module)
+	handler.Listen(func(msg *pubsub.Message) {
+		received <- msg.GetContent()
+	}, "BTC")
+
+	for i := range 3 {
+		broker.Publish("BTC", i)
+	}
+	for i := range 3 {
+		require.Equal(t, i, <-received)
+	}
+}
+
+func Test_HandlerSlow(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{BufferSize: 1})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	// Publishers wait for a slow handler longer than DefaultBlockTimeout
+	// rather than drop its messages.
+	var calls atomic.Int32
+	received := make(chan any, 10)
+	pubsub.NewHandler(module).Listen(func(msg *pubsub.Message) {
+		if calls.Add(1) == 1 {
+			time.Sleep(2 * pubsub.DefaultBlockTimeout)
+		}
+		received <- msg.GetContent()
+	}, "BTC")
+
+	for i := range 6 {
+		broker.Publish("BTC", i)
+	}
+	for i := range 6 {
+		select {
+		case content := <-received:
+			require.Equal(t, i, content)
+		case <-time.After(time.Second):
+			t.Fatalf("handled %d of 6 messages", i)
+		}
+	}
+	require.Zero(t, broker.Dropped())
+}
+
+func Test_HandlerRetry(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{
+			AtLeastOnce: true,
+			DeadLetter:  &pubsub.DeadLetterPolicy{MaxDeliveries: 1},
+		})},
+	})
+	broker := pubsub.InjectBroker(module)
+	dlq := broker.AddSubscriber()
+	broker.Subscribe(dlq, "BTC.dlq")
+
+	calls := 0
+	failed := make(chan error, 1)
+	handler := pubsub.NewHandler(module)
+	handler.ListenWithOptions(func(msg *pubsub.Message) error {
+		calls++
+		if msg.GetContent() == "panic" {
+			panic("boom")
+		}
+		if calls < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}, pubsub.ListenOptions{
+		Topics:     []string{"BTC"},
+		Retries:    2,
+		MinBackoff: time.Millisecond,
+		Jitter:     0.5,
+		OnError: func(msg *pubsub.Message, err error) {
+			failed <- err
+		},
+	})
+
+	broker.Publish("BTC", "price")
+	broker.Publish("BTC", "panic")
+
+	err := <-failed
+	var panicErr *pubsub.PanicError
+	require.ErrorAs(t, err, &panicErr)
+	require.Equal(t, "boom", panicErr.Value)
+	require.Equal(t, 6, calls)
+
+	msg := <-dlq.GetMessages()
+	msg.Ack()
+	letter := msg.GetContent().(*pubsub.DeadLetter)
+	require.Equal(t, "panic", letter.Content)
+	require.Equal(t, err.Error(), letter.Reason)
+	require.Equal(t, 0, broker.Unacked())
+}
+
+func Test_HandlerRequeue(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{AtLeastOnce: true})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	var calls atomic.Int32
+	handled := make(chan int, 1)
+	handler := pubsub.NewHandler(module)
+	handler.ListenWithOptions(func(msg *pubsub.Message) error {
+		if calls.Add(1) == 1 {
+			return errors.New("unavailable")
+		}
+		handled <- msg.GetAttempts()
+		return nil
+	}, pubsub.ListenOptions{
+		Topics:  []string{"BTC"},
+		OnError: func(msg *pubsub.Message, err error) {},
+	})
+
+	// A message still failing after its retries is redelivered.
+	broker.Publish("BTC", "price")
+	require.Equal(t, 2, <-handled)
+	require.Equal(t, int32(2), calls.Load())
+	require.Eventually(t, func() bool {
+		return broker.Unacked() == 0
+	}, time.Second, 5*time.Millisecond)
+
+	// Without a dead-letter policy, a message that always fails keeps being
+	// redelivered, with a growing backoff between the deliveries.
+	var failures atomic.Int32
+	pubsub.NewHandler(module).ListenWithOptions(func(msg *pubsub.Message) error {
+		failures.Add(1)
+		return errors.New("unavailable")
+	}, pubsub.ListenOptions{
+		Topics:     []string{"ETH"},
+		MinBackoff: 20 * time.Millisecond,
+		OnError:    func(msg *pubsub.Message, err error) {},
+	})
+	broker.Publish("ETH", "price")
+	time.Sleep(200 * time.Millisecond)
+	require.GreaterOrEqual(t, failures.Load(), int32(2))
+	require.LessOrEqual(t, failures.Load(), int32(5))
+}
+
+func Test_HandlerConcurrency(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	var mutex sync.Mutex
+	running, peak := 0, 0
+	order := map[string][]int{}
+	handler := pubsub.NewHandler(module)
+	handler.ListenWithOptions(func(msg *pubsub.Message) error {
+		payload := msg.GetContent().([]any)
+		mutex.Lock()
+		running++
+		peak = max(peak, running)
+		order[payload[0].(string)] = append(order[payload[0].(string)], payload[1].(int))
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return nil
+	}, pubsub.ListenOptions{
+		Topics:      []string{"accounts"},
+		Concurrency: 4,
+		Key: func(msg *pubsub.Message) string {
+			return msg.GetContent().([]any)[0].(string)
+		},
+	})
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for i := range 5 {
+		for _, key := range keys {
+			broker.Publish("accounts", []any{key, i})
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		total := 0
+		for _, values := range order {
+			total += len(values)
+		}
+		return total == 30
+	}, time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, handler.Drain(ctx))
+
+	require.Greater(t, peak, 1)
+	require.LessOrEqual(t, peak, 4)
+	for _, key := range keys {
+		require.Equal(t, []int{0, 1, 2, 3, 4}, order[key])
+	}
+}
+
+func Test_HandlerDrain(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := pubsub.NewHandler(module)
+	handler.ListenWithOptions(func(msg *pubsub.Message) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, pubsub.ListenOptions{
+		Topics:      []string{"jobs"},
+		Concurrency: 2,
+	})
+	require.Nil(t, handler.Drain(context.Background()))
+
+	broker.Publish("jobs", 1)
+	broker.Publish("jobs", 2)
+	<-started
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, handler.Drain(ctx), context.DeadlineExceeded)
+
+	close(release)
+	require.Nil(t, handler.Drain(context.Background()))
+}
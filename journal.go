@@ -0,0 +1,382 @@
+package pubsub
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+const (
+	// truncateEvery is how many delivered messages the journal waits for
+	// before truncating the store.
+	truncateEvery = 256
+	// recoverBatch is how many records Recover reads from the store at once.
+	recoverBatch = 256
+)
+
+// journal persists the published messages in the store of the broker and
+// truncates the store once they are delivered.
+//
+// Every message handed to a subscriber holds a ticket on the offset of the
+// message, released when the delivery completes: when the subscriber
+// receives the message or, with AtLeastOnce, when the message is acknowledged
+// or dead-lettered. The store is truncated up to the oldest message being
+// published or with a ticket still held, and never past the position of a
+// durable subscription.
+type journal struct {
+	store       Store
+	codec       Codec
+	closed      *atomic.Bool // Closed flag of the broker
+	durables    *durables    // Durable subscriptions of the broker
+	mutex       sync.Mutex
+	publishing  map[uint64]int // Messages being published by offset
+	outstanding map[uint64]int // Tickets held by offset
+	next        uint64         // Offset after the last message seen
+	truncated   uint64         // Offset the store was last truncated at
+	released    int            // Tickets released since the last truncation
+	start       uint64         // First offset appended by this broker
+	started     bool
+	recovered   bool
+}
+
+type ticket struct {
+	journal  *journal
+	durable  *durable // Durable subscription the message is delivered to
+	offset   uint64
+	released atomic.Bool
+}
+
+func newJournal(store Store, codec Codec, closed *atomic.Bool, durables *durables) *journal {
+	return &journal{
+		store:       store,
+		codec:       codec,
+		closed:      closed,
+		durables:    durables,
+		publishing:  map[uint64]int{},
+		outstanding: map[uint64]int{},
+	}
+}
+
+// append persists the message and marks it as being published until
+// published is called.
+func (j *journal) append(m *Message) error {
+	payload, err := j.codec.Marshal(m.topic, m.content)
+	if err != nil {
+		return err
+	}
+	offset, err := j.store.Append(newRecord(m, payload))
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	m.offset = offset
+	j.publishing[offset]++
+	j.next = max(j.next, offset+1)
+	if !j.started {
+		j.start, j.started = offset, true
+	}
+	return nil
+}
+
+// published marks the message at the offset as handed to its recipients.
+func (j *journal) published(offset uint64) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.publishing[offset]--
+	if j.publishing[offset] <= 0 {
+		delete(j.publishing, offset)
+	}
+}
+
+// ticket holds a new ticket on the offset, for the given durable
+// subscription if any.
+func (j *journal) ticket(offset uint64, d *durable) *ticket {
+	j.mutex.Lock()
+	j.outstanding[offset]++
+	j.mutex.Unlock()
+
+	if d != nil {
+		d.hold(offset)
+	}
+	return &ticket{journal: j, durable: d, offset: offset}
+}
+
+// inflight returns the offset of the oldest message being published, or the
+// next offset when no message is. The caller must hold the mutex.
+func (j *journal) inflight() uint64 {
+	head := j.next
+	for offset := range j.publishing {
+		head = min(head, offset)
+	}
+	return head
+}
+
+// nextOffset returns the offset after the last message seen.
+func (j *journal) nextOffset() uint64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.next
+}
+
+// inflightOffset works like inflight, taking the mutex.
+func (j *journal) inflightOffset() uint64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.inflight()
+}
+
+// release gives back a ticket on the offset, truncating the store every
+// truncateEvery tickets.
+func (j *journal) release(offset uint64) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.outstanding[offset]--
+	if j.outstanding[offset] <= 0 {
+		delete(j.outstanding, offset)
+	}
+	j.released++
+	if j.released >= truncateEvery {
+		j.truncate()
+	}
+}
+
+// truncate removes the delivered messages from the store. Nothing is removed
+// before the messages left by the previous run, if any, are recovered. The
+// caller must hold the mutex.
+func (j *journal) truncate() {
+	if !j.recovered {
+		return
+	}
+	j.released = 0
+
+	head := j.inflight()
+	for offset := range j.outstanding {
+		head = min(head, offset)
+	}
+	for _, position := range j.checkpoint() {
+		head = min(head, position)
+	}
+	if head <= j.truncated {
+		return
+	}
+	if err := j.store.Truncate(head); err != nil {
+		log.Println(err)
+		return
+	}
+	j.truncated = head
+}
+
+// recover reads the messages left in the store by a previous run and holds
+// a ticket on each of them. It returns nothing once called.
+func (j *journal) recover(b *Broker) ([]*Message, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.recovered {
+		return nil, nil
+	}
+
+	var messages []*Message
+	var errs []error
+	from := uint64(0)
+	for {
+		records, err := j.store.Read(from, recoverBatch)
+		if err != nil {
+			return messages, errors.Join(append(errs, err)...)
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, record := range records {
+			from = record.Offset + 1
+			if j.started && record.Offset >= j.start {
+				return messages, errors.Join(errs...)
+			}
+
+			m, err := j.message(record, b)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			messages = append(messages, m)
+			j.publishing[record.Offset]++
+			j.next = max(j.next, from)
+		}
+	}
+	return messages, errors.Join(errs...)
+}
+
+// newRecord returns a record of the message with the encoded payload.
+func newRecord(m *Message, payload []byte) *Record {
+	return &Record{
+		Topic:          m.topic,
+		ID:             m.id,
+		PublishedAt:    m.publishedAt,
+		Publisher:      m.publisher,
+		CorrelationID:  m.correlationID,
+		CausationID:    m.causationID,
+		Key:            m.key,
+		Priority:       m.priority,
+		IdempotencyKey: m.idempotencyKey,
+		Headers:        m.headers,
+		Retain:         m.retain,
+		TTL:            m.ttl,
+		Payload:        payload,
+	}
+}
+
+// message decodes a record of the store.
+func (j *journal) message(record *Record, b *Broker) (*Message, error) {
+	payload, err := j.codec.Unmarshal(record.Topic, record.Payload)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{
+		topic:          record.Topic,
+		content:        payload,
+		id:             record.ID,
+		publishedAt:    record.PublishedAt,
+		publisher:      record.Publisher,
+		correlationID:  record.CorrelationID,
+		causationID:    record.CausationID,
+		key:            record.Key,
+		priority:       record.Priority,
+		idempotencyKey: record.IdempotencyKey,
+		headers:        record.Headers,
+		broker:         b,
+		retain:         record.Retain,
+		offset:         record.Offset,
+	}
+	m.restoreExpiry(record.TTL)
+	return m, nil
+}
+
+// load marks the journal as recovered when the store holds no message of a
+// previous run, so the store is truncated without waiting for Recover.
+func (j *journal) load() error {
+	records, err := j.store.Read(0, 1)
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.recovered = len(records) == 0
+	return nil
+}
+
+// finishRecovery allows the store to be truncated.
+func (j *journal) finishRecovery() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.recovered = true
+	j.truncate()
+}
+
+// close truncates the delivered messages and closes the store.
+func (j *journal) close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.truncate()
+	j.checkpoint()
+	return j.store.Close()
+}
+
+// release completes the delivery tracked by the ticket. Releasing a ticket
+// twice, or a nil ticket, has no effect.
+func (t *ticket) release() {
+	if t != nil && t.released.CompareAndSwap(false, true) {
+		t.journal.release(t.offset)
+		if t.durable != nil {
+			t.durable.complete(t.offset)
+		}
+	}
+}
+
+// discard gives back the ticket without completing the delivery, so a
+// durable subscription resumes before the message. Nothing is given back
+// once the broker is shutting down: the message then stays in the store to
+// be recovered by the next run.
+func (t *ticket) discard() {
+	if t != nil && !t.journal.closed.Load() && t.released.CompareAndSwap(false, true) {
+		t.journal.release(t.offset)
+	}
+}
+
+// handed marks the message as received by the subscriber. Without
+// acknowledgements, this completes its delivery, with them it starts the ack
+// deadline.
+func (m *Message) handed() {
+	if m.delivery == nil {
+		m.ticket.release()
+		return
+	}
+	m.delivery.start(m)
+}
+
+// discard gives back the ticket of a message that will not reach its
+// subscriber. A message tracked for acknowledgement is settled and handed
+// to redeliver, which drops it when the subscriber is removed.
+func (m *Message) discard() {
+	if m.settle() {
+		m.delivery.broker.redeliver(m.delivery.subscriber, m)
+		return
+	}
+	m.ticket.discard()
+}
+
+// Recover delivers the messages left undelivered in the store by a previous
+// run of the broker, as if they were published again with their original
+// metadata. It returns how many messages were recovered.
+//
+// Recover should be called once, after the subscribers are set up; later
+// calls recover nothing. The scheduled messages saved in the store are
+// published from then on. When the store holds messages of a previous run,
+// it is not truncated before Recover is called. Records whose payload cannot
+// be decoded are skipped and their errors returned.
+func (b *Broker) Recover() (int, error) {
+	if b.journal == nil {
+		return 0, nil
+	}
+
+	messages, err := b.journal.recover(b)
+	for _, m := range messages {
+		if m.retain {
+			b.retain(m)
+		}
+		b.deliver(m)
+		b.journal.published(m.offset)
+	}
+	b.journal.finishRecovery()
+	b.scheduler.release()
+	return len(messages), err
+}
+
+// RecoverHook recovers the messages left in the store of the broker provided
+// by ForRoot when the module is initialized. Register it on the application
+// module, so it runs once the other modules have subscribed:
+//
+//	appModule := core.NewModule(core.NewModuleOptions{...})
+//	appModule.OnInit(pubsub.RecoverHook)
+func RecoverHook(module core.Module) {
+	broker := InjectBroker(module)
+	if broker == nil {
+		return
+	}
+	if _, err := broker.Recover(); err != nil {
+		log.Printf("pubsub: recover messages: %v\n", err)
+	}
+}
@@ -0,0 +1,155 @@
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+func openStore(t *testing.T, dir string) *pubsub.FileStore {
+	store, err := pubsub.OpenFileStore(dir)
+	require.Nil(t, err)
+	return store
+}
+
+func Test_JournalRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	recovered, err := broker.Recover()
+	require.Nil(t, err)
+	require.Equal(t, 0, recovered)
+
+	reader := broker.AddSubscriber()
+	broker.Subscribe(reader, "orders")
+	broker.Publish("orders", "delivered")
+	require.Equal(t, "delivered", (<-reader.GetMessages()).GetContent())
+	broker.Unsubscribe(reader, "orders")
+
+	stuck := broker.AddSubscriber()
+	broker.Subscribe(stuck, "orders")
+	var ids []string
+	for _, content := range []string{"first", "second", "third"} {
+		result, err := broker.PublishWithOptions("orders", content, pubsub.WithHeader("tenant", "acme"))
+		require.Nil(t, err)
+		ids = append(ids, result.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = broker.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The next run delivers the messages the first one could not.
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	recovered, err = broker.Recover()
+	require.Nil(t, err)
+	require.Equal(t, 3, recovered)
+
+	for i, content := range []string{"first", "second", "third"} {
+		msg := <-sub.GetMessages()
+		require.Equal(t, content, msg.GetContent())
+		require.Equal(t, ids[i], msg.GetID())
+		require.Equal(t, "acme", msg.GetHeader("tenant"))
+	}
+	recovered, err = broker.Recover()
+	require.Nil(t, err)
+	require.Equal(t, 0, recovered)
+
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{Store: openStore(t, dir)})
+	recovered, err = broker.Recover()
+	require.Nil(t, err)
+	require.Equal(t, 0, recovered)
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+}
+
+func Test_JournalUnacked(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{AtLeastOnce: true, Store: openStore(t, dir)})
+	_, err := broker.Recover()
+	require.Nil(t, err)
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "payments")
+	broker.Publish("payments", "acked")
+	broker.Publish("payments", "unacked")
+	(<-sub.GetMessages()).Ack()
+	require.Equal(t, "unacked", (<-sub.GetMessages()).GetContent())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = broker.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{
+			AtLeastOnce: true,
+			Store:       openStore(t, dir),
+		})},
+	})
+	broker = pubsub.InjectBroker(module)
+	sub = broker.AddSubscriber()
+	broker.Subscribe(sub, "payments")
+	pubsub.RecoverHook(module)
+
+	msg := <-sub.GetMessages()
+	require.Equal(t, "unacked", msg.GetContent())
+	msg.Ack()
+	require.Empty(t, drain(sub))
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+}
+
+func Test_JournalTruncate(t *testing.T) {
+	// An empty store is truncated without waiting for Recover.
+	store := pubsub.NewMemoryStore()
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{Store: store})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	for i := 0; i < 300; i++ {
+		broker.Publish("orders", i)
+		<-sub.GetMessages()
+	}
+	records, err := store.Read(0, 1)
+	require.Nil(t, err)
+	require.Greater(t, records[0].Offset, uint64(0))
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	// Nothing is truncated before the previous run is recovered.
+	store = pubsub.NewMemoryStore()
+	appendRecords(t, store, "orders", 1)
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{Store: store})
+
+	sub = broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	for i := 0; i < 300; i++ {
+		broker.Publish("orders", i)
+		<-sub.GetMessages()
+	}
+	records, err = store.Read(0, 1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), records[0].Offset)
+
+	recovered, err := broker.Recover()
+	require.Nil(t, err)
+	require.Equal(t, 1, recovered)
+	require.Equal(t, float64(1), (<-sub.GetMessages()).GetContent())
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+	records, err = store.Read(0, 0)
+	require.Nil(t, err)
+	require.Empty(t, records)
+}
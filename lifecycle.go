@@ -0,0 +1,128 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+// drainInterval is how often Shutdown checks whether the subscribers have
+// received their queued messages.
+const drainInterval = 5 * time.Millisecond
+
+// ShutdownReport tells what was left behind when the broker shut down.
+type ShutdownReport struct {
+	// messages still queued for subscribers when they were closed
+	Undelivered int
+	// delivered messages that were never acknowledged
+	Unacked int
+}
+
+// Shutdown stops the broker.
+//
+// The broker stops accepting publishes and new subscribers right away. It then
+// waits until the subscribers have received their queued messages, and when
+// AtLeastOnce is enabled acknowledged them, or until the context is done.
+// Finally every subscriber is removed, which closes its message channel and
+// ends the handlers listening to it.
+//
+// The report counts the messages that were not delivered or acknowledged. The
+// error of the context is returned when it is done before the broker drained.
+// Calling Shutdown on a closed broker returns an empty report.
+//
+// When the broker has a Store, the messages left undelivered or unacknowledged
+// stay in the store, to be recovered by the next run, and the store is
+// closed. Its error is returned as well, like the errors closing the stores
+// of the streams. Scheduled messages not yet published stay in a
+// ScheduledStore, and are dropped otherwise. The schedules added with
+// Schedule are removed.
+func (b *Broker) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	if !b.closed.CompareAndSwap(false, true) {
+		return ShutdownReport{}, nil
+	}
+
+	b.scheduler.stop()
+	b.stopSchedules()
+	err := b.drain(ctx)
+
+	b.mutex.RLock()
+	subscribers := make([]*Subscriber, 0, len(b.subscribers))
+	for _, s := range b.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	b.mutex.RUnlock()
+
+	report := ShutdownReport{Unacked: b.Unacked()}
+	for _, s := range subscribers {
+		report.Undelivered += s.Pending()
+		b.RemoveSubscriber(s)
+	}
+	err = errors.Join(err, b.closeStreams())
+	if b.journal != nil {
+		err = errors.Join(err, b.journal.close())
+	}
+	return report, err
+}
+
+// IsClosed reports whether the broker has been shut down.
+func (b *Broker) IsClosed() bool {
+	return b.closed.Load()
+}
+
+// drain waits until no message is pending or unacknowledged.
+func (b *Broker) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for !b.drained() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *Broker) drained() bool {
+	if b.opt.AtLeastOnce && b.Unacked() > 0 {
+		return false
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, s := range b.subscribers {
+		if s.Pending() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ShutdownHook shuts the broker provided by ForRoot down when the application
+// stops, after its HTTP server is closed. Queued messages are drained for up
+// to the given timeout.
+//
+//	app := core.CreateFactory(appModule)
+//	pubsub.ShutdownHook(app, 5*time.Second)
+//	app.Listen(3000)
+func ShutdownHook(app *core.App, timeout time.Duration) *core.App {
+	return app.AfterShutdown(func() {
+		broker := InjectBroker(app.Module)
+		if broker == nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		report, err := broker.Shutdown(ctx)
+		if err != nil {
+			log.Printf("pubsub: broker shutdown: %v, %d undelivered and %d unacked messages\n", err, report.Undelivered, report.Unacked)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_Shutdown(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		AtLeastOnce: true,
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	for i := range 5 {
+		broker.Publish("orders", i)
+	}
+
+	received := make(chan any, 5)
+	go func() {
+		for msg := range sub.GetMessages() {
+			time.Sleep(time.Millisecond)
+			received <- msg.GetContent()
+			msg.Ack()
+		}
+		close(received)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, err := broker.Shutdown(ctx)
+	require.Nil(t, err)
+	require.Equal(t, pubsub.ShutdownReport{}, report)
+	require.True(t, broker.IsClosed())
+	require.False(t, sub.IsActive())
+
+	var contents []any
+	for content := range received {
+		contents = append(contents, content)
+	}
+	require.Equal(t, []any{0, 1, 2, 3, 4}, contents)
+
+	broker.Publish("orders", 5)
+	require.Nil(t, broker.AddSubscriber())
+
+	report, err = broker.Shutdown(ctx)
+	require.Nil(t, err)
+	require.Equal(t, pubsub.ShutdownReport{}, report)
+}
+
+func Test_ShutdownTimeout(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		Delivery: pubsub.DeliveryConcurrent,
+	})
+
+	sub := broker.AddSubscriber()
+	sub.Signal(pubsub.NewMessage("orders", 1))
+	sub.Signal(pubsub.NewMessage("orders", 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	report, err := broker.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 2, report.Undelivered)
+	require.False(t, sub.IsActive())
+}
@@ -1,8 +1,34 @@
 package pubsub
 
+import (
+	"maps"
+	"time"
+)
+
 type Message struct {
-	topic   string
-	content interface{}
+	topic            string
+	content          interface{}
+	id               string
+	publishedAt      time.Time
+	publisher        string
+	correlationID    string
+	causationID      string
+	key              string
+	priority         int
+	idempotencyKey   string
+	headers          map[string]string // Shared by the copies of a message, never modified
+	broker           *Broker           // Broker the message was published to
+	retain           bool
+	ttl              time.Duration
+	expiresAt        time.Time
+	offset           uint64  // Offset in the store of the broker
+	ticket           *ticket // Delivery tracked by the journal of the broker
+	streamOffset     uint64  // Offset in the stream of the topic
+	group            *group  // Consumer group the message was delivered through
+	attempts         int
+	firstDeliveredAt time.Time
+	deliveredAt      time.Time
+	delivery         *delivery
 }
 
 // NewMessage returns a new Message with the given topic and content.
@@ -23,4 +49,84 @@ func (m *Message) GetContent() interface{} {
 	return m.content
 }
 
+// GetID returns the unique ID the message was published with. Every
+// subscriber receiving the message, and every redelivery of it, sees the same
+// ID.
+func (m *Message) GetID() string {
+	return m.id
+}
+
+// GetPublishedAt returns when the message was published.
+func (m *Message) GetPublishedAt() time.Time {
+	return m.publishedAt
+}
+
+// GetPublisher returns the identifier of the publisher given with
+// WithPublisher, or an empty string.
+func (m *Message) GetPublisher() string {
+	return m.publisher
+}
+
+// GetCorrelationID returns the ID shared by all the messages of one
+// conversation or workflow, given with WithCorrelationID or WithCausedBy.
+func (m *Message) GetCorrelationID() string {
+	return m.correlationID
+}
+
+// GetCausationID returns the ID of the message that caused this one, given
+// with WithCausationID or WithCausedBy.
+func (m *Message) GetCausationID() string {
+	return m.causationID
+}
+
+// GetKey returns the key given with WithKey, or an empty string.
+func (m *Message) GetKey() string {
+	return m.key
+}
+
+// GetHeader returns the value of the given header, or an empty string.
+func (m *Message) GetHeader(key string) string {
+	return m.headers[key]
+}
+
+// GetHeaders returns a copy of the headers of the message.
+func (m *Message) GetHeaders() map[string]string {
+	headers := make(map[string]string, len(m.headers))
+	maps.Copy(headers, m.headers)
+	return headers
+}
+
+// GetAttempts returns how many times the message has been delivered to the
+// subscriber, starting at 1. It is 0 when the broker does not track
+// acknowledgements.
+func (m *Message) GetAttempts() int {
+	return m.attempts
+}
+
+// clone returns a copy of the message with its metadata, but without its
+// delivery state.
+func (m *Message) clone() *Message {
+	return &Message{
+		topic:          m.topic,
+		content:        m.content,
+		id:             m.id,
+		publishedAt:    m.publishedAt,
+		publisher:      m.publisher,
+		correlationID:  m.correlationID,
+		causationID:    m.causationID,
+		key:            m.key,
+		priority:       m.priority,
+		idempotencyKey: m.idempotencyKey,
+		headers:        m.headers,
+		broker:         m.broker,
+		retain:         m.retain,
+		ttl:            m.ttl,
+		expiresAt:      m.expiresAt,
+		offset:         m.offset,
+		ticket:         m.ticket,
+		streamOffset:   m.streamOffset,
+		group:          m.group,
+	}
+}
+
 type MessageChannel chan Message
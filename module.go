@@ -1,17 +1,23 @@
 package pubsub
 
 import (
+	"log"
+
 	"github.com/tinh-tinh/tinhtinh/v2/core"
 )
 
 const BROKER core.Provide = "broker"
 const SUBSCRIBER core.Provide = "subscriber"
+const SCHEDULES core.Provide = "schedules"
 
 // ForRoot returns a module that provides the broker.
 //
 // The module provides the broker as a dependency to other modules. The broker
 // is the central entity of the pub/sub pattern. It is responsible for managing
 // the subscribers and topics.
+//
+// Pass the application to ShutdownHook to shut the broker down with the
+// application.
 func ForRoot(opt BrokerOptions) core.Modules {
 	return func(module core.Module) core.Module {
 		pubModule := module.New(core.NewModuleOptions{})
@@ -68,6 +74,92 @@ func ForFeature(topics ...string) core.Modules {
 	}
 }
 
+// ForFeatureGroup returns a module that provides a subscriber joining the given
+// consumer group on the specified topics.
+//
+// Every message published to the topics is delivered to only one member of the
+// group, so several modules or application instances importing ForFeatureGroup
+// with the same group share the work.
+func ForFeatureGroup(group string, topics ...string) core.Modules {
+	return func(module core.Module) core.Module {
+		subModule := module.New(core.NewModuleOptions{})
+		subModule.NewProvider(core.ProviderOptions{
+			Name: SUBSCRIBER,
+			Factory: func(param ...interface{}) interface{} {
+				broker := param[0].(*Broker)
+				s := broker.AddSubscriber()
+				for _, topic := range topics {
+					broker.SubscribeGroup(s, topic, group)
+				}
+				return s
+			},
+			Inject: []core.Provide{BROKER},
+		})
+		subModule.Export(SUBSCRIBER)
+
+		return subModule
+	}
+}
+
+// ForFeatureDurable returns a module that provides a durable subscriber
+// identified by the given name, subscribed to the specified topics.
+//
+// When the application restarts, the subscriber provided under the same name
+// resumes where the previous one left off, as described by
+// AddDurableSubscriber.
+func ForFeatureDurable(name string, topics ...string) core.Modules {
+	return func(module core.Module) core.Module {
+		subModule := module.New(core.NewModuleOptions{})
+		subModule.NewProvider(core.ProviderOptions{
+			Name: SUBSCRIBER,
+			Factory: func(param ...interface{}) interface{} {
+				broker := param[0].(*Broker)
+				return broker.AddDurableSubscriber(name, topics...)
+			},
+			Inject: []core.Provide{BROKER},
+		})
+		subModule.Export(SUBSCRIBER)
+
+		return subModule
+	}
+}
+
+// ForSchedule returns a module adding the given schedules to the broker
+// provided by ForRoot, so they are declared alongside it:
+//
+//	Imports: []core.Modules{
+//		pubsub.ForRoot(pubsub.BrokerOptions{}),
+//		pubsub.ForSchedule(pubsub.CronJob{Expr: "*/5 * * * *", Topic: "ticks", Payload: tick}),
+//	}
+//
+// The module provides the IDs of the schedules. A schedule that cannot be
+// added is logged and skipped.
+func ForSchedule(jobs ...CronJob) core.Modules {
+	return func(module core.Module) core.Module {
+		cronModule := module.New(core.NewModuleOptions{})
+		cronModule.NewProvider(core.ProviderOptions{
+			Name: SCHEDULES,
+			Factory: func(param ...interface{}) interface{} {
+				broker := param[0].(*Broker)
+				ids := make([]string, 0, len(jobs))
+				for _, job := range jobs {
+					id, err := broker.Schedule(job.Expr, job.Topic, job.Payload, job.Options)
+					if err != nil {
+						log.Printf("pubsub: schedule %q on %s: %v\n", job.Expr, job.Topic, err)
+						continue
+					}
+					ids = append(ids, id)
+				}
+				return ids
+			},
+			Inject: []core.Provide{BROKER},
+		})
+		cronModule.Export(SCHEDULES)
+
+		return cronModule
+	}
+}
+
 // InjectSubscriber returns the subscriber from the given module.
 //
 // The subscriber is the entity that receives messages published to the topics it
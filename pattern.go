@@ -0,0 +1,148 @@
+package pubsub
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// PatternPrefix prefixes the key of a regular expression subscription.
+	PatternPrefix = "regexp:"
+	// FuncPrefix prefixes the key of a predicate subscription.
+	FuncPrefix = "func:"
+)
+
+// matchCacheSize bounds the number of published topics whose matching
+// patterns are cached.
+const matchCacheSize = 4096
+
+var funcSeq atomic.Uint64
+
+// SubscribePattern adds the subscriber to every topic matching the given
+// regular expression.
+//
+// The subscription is registered under the key PatternPrefix followed by the
+// expression, which is reported by GetTopic and can be passed to Unsubscribe.
+// Subscribers using the same expression share the key. An empty key is
+// returned when TrySubscribePattern would return an error.
+func (b *Broker) SubscribePattern(s *Subscriber, pattern *regexp.Regexp) string {
+	key, _ := b.TrySubscribePattern(s, pattern)
+	return key
+}
+
+// TrySubscribePattern works like SubscribePattern, but returns
+// ErrBrokerClosed when the broker is shut down and ErrSubscriberInactive when
+// the subscriber has been removed.
+func (b *Broker) TrySubscribePattern(s *Subscriber, pattern *regexp.Regexp) (string, error) {
+	key := PatternPrefix + pattern.String()
+	if err := b.subscribeMatcher(s, key, pattern.MatchString); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// SubscribeFunc adds the subscriber to every topic for which the given
+// predicate returns true.
+//
+// The subscription is registered under a unique key starting with FuncPrefix,
+// which is returned so the subscription can later be passed to Unsubscribe.
+// The predicate must be safe to call concurrently. An empty key is returned
+// when TrySubscribeFunc would return an error.
+func (b *Broker) SubscribeFunc(s *Subscriber, match func(topic string) bool) string {
+	key, _ := b.TrySubscribeFunc(s, match)
+	return key
+}
+
+// TrySubscribeFunc works like SubscribeFunc, but returns ErrBrokerClosed when
+// the broker is shut down and ErrSubscriberInactive when the subscriber has
+// been removed.
+func (b *Broker) TrySubscribeFunc(s *Subscriber, match func(topic string) bool) (string, error) {
+	key := fmt.Sprintf("%s%d", FuncPrefix, funcSeq.Add(1))
+	if err := b.subscribeMatcher(s, key, match); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (b *Broker) subscribeMatcher(s *Subscriber, key string, match func(topic string) bool) error {
+	if err := b.checkSubscriber(s); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	if _, ok := b.matchers[key]; !ok {
+		b.matchers[key] = match
+		b.resetMatchCache()
+	}
+	added := b.subscribe(s, key)
+	b.mutex.Unlock()
+
+	if added {
+		b.deliverRetained(s, match)
+	}
+	return nil
+}
+
+// matchPatterns returns the keys of the pattern and predicate subscriptions
+// matching the published topic. The caller must hold the mutex.
+func (b *Broker) matchPatterns(topic string) []string {
+	if len(b.matchers) == 0 {
+		return nil
+	}
+	if keys, ok := b.matchCache.get(topic); ok {
+		return keys
+	}
+
+	var keys []string
+	for key, match := range b.matchers {
+		if match(topic) {
+			keys = append(keys, key)
+		}
+	}
+	b.matchCache.set(topic, keys)
+	return keys
+}
+
+// resetMatchCache forgets the cached matches after a pattern is added or
+// removed. The caller must hold the mutex for writing.
+func (b *Broker) resetMatchCache() {
+	b.matchCache.reset()
+}
+
+// matchCache remembers which pattern keys match a published topic. Publishers
+// only hold the read lock of the broker, so the cache has a lock of its own.
+type matchCache struct {
+	mutex   sync.Mutex
+	entries map[string][]string
+}
+
+func newMatchCache() *matchCache {
+	return &matchCache{entries: map[string][]string{}}
+}
+
+func (c *matchCache) get(topic string) ([]string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	keys, ok := c.entries[topic]
+	return keys, ok
+}
+
+func (c *matchCache) set(topic string, keys []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entries) >= matchCacheSize {
+		c.entries = map[string][]string{}
+	}
+	c.entries[topic] = keys
+}
+
+func (c *matchCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = map[string][]string{}
+}
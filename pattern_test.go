@@ -0,0 +1,86 @@
+package pubsub_test
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_SubscribePattern(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	sub := broker.AddSubscriber()
+	key := broker.SubscribePattern(sub, regexp.MustCompile(`^tenant-[0-9]+\.audit$`))
+	require.Equal(t, "regexp:^tenant-[0-9]+\\.audit$", key)
+	require.Equal(t, []string{key}, sub.GetTopic())
+	require.Equal(t, 1, broker.GetSubscribers(key))
+
+	broker.Publish("tenant-42.audit", "login")
+	broker.Publish("tenant-x.audit", "ignored")
+	broker.Publish("tenant-7.audit", "logout")
+
+	msg := <-sub.GetMessages()
+	require.Equal(t, "tenant-42.audit", msg.GetTopic())
+	require.Equal(t, "login", msg.GetContent())
+	msg = <-sub.GetMessages()
+	require.Equal(t, "tenant-7.audit", msg.GetTopic())
+
+	broker.Unsubscribe(sub, key)
+	require.Empty(t, sub.GetTopic())
+	broker.Publish("tenant-42.audit", "after")
+	require.Empty(t, drain(sub))
+}
+
+func Test_SubscribeFunc(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	calls := 0
+	sub := broker.AddSubscriber()
+	key := broker.SubscribeFunc(sub, func(topic string) bool {
+		calls++
+		return strings.HasSuffix(topic, ".audit")
+	})
+	require.True(t, strings.HasPrefix(key, pubsub.FuncPrefix))
+
+	// Subscribers of the exact topic and of the predicate both receive it once.
+	exact := broker.AddSubscriber()
+	broker.Subscribe(exact, "billing.audit")
+	broker.Subscribe(sub, "billing.audit")
+
+	for range 3 {
+		broker.Publish("billing.audit", "entry")
+	}
+	require.Equal(t, 1, calls)
+
+	for range 3 {
+		require.Equal(t, "entry", (<-sub.GetMessages()).GetContent())
+		require.Equal(t, "entry", (<-exact.GetMessages()).GetContent())
+	}
+	require.Empty(t, drain(sub))
+}
+
+func Test_TrySubscribePattern(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	pattern := regexp.MustCompile(`^orders\.`)
+
+	removed := broker.AddSubscriber()
+	broker.RemoveSubscriber(removed)
+	_, err := broker.TrySubscribePattern(removed, pattern)
+	require.ErrorIs(t, err, pubsub.ErrSubscriberInactive)
+	_, err = broker.TrySubscribeFunc(removed, func(topic string) bool { return true })
+	require.ErrorIs(t, err, pubsub.ErrSubscriberInactive)
+	require.Empty(t, broker.SubscribePattern(removed, pattern))
+	require.Zero(t, broker.GetSubscribers(pubsub.PatternPrefix+pattern.String()))
+
+	sub := broker.AddSubscriber()
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+	_, err = broker.TrySubscribePattern(sub, pattern)
+	require.ErrorIs(t, err, pubsub.ErrBrokerClosed)
+	_, err = broker.TrySubscribeFunc(sub, func(topic string) bool { return true })
+	require.ErrorIs(t, err, pubsub.ErrBrokerClosed)
+}
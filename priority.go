@@ -0,0 +1,26 @@
+package pubsub
+
+const (
+	// MinPriority is the lowest priority of a message, and the priority of
+	// messages published without WithPriority.
+	MinPriority = 0
+	// MaxPriority is the highest priority of a message.
+	MaxPriority = 9
+)
+
+// WithPriority sets the priority of the message, from MinPriority to
+// MaxPriority. Out of range priorities are clamped.
+//
+// Subscribers created with the Priority option dispatch the messages waiting
+// in their queue by decreasing priority, and in the order they were signalled
+// within a priority. Other subscribers ignore it.
+func WithPriority(priority int) PublishOption {
+	return func(m *Message) {
+		m.priority = min(max(priority, MinPriority), MaxPriority)
+	}
+}
+
+// GetPriority returns the priority given with WithPriority, or MinPriority.
+func (m *Message) GetPriority() int {
+	return m.priority
+}
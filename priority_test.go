@@ -0,0 +1,91 @@
+package pubsub_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+func Test_Priority(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	prioritized := broker.AddSubscriber(pubsub.SubscriberOptions{Priority: true})
+	broker.Subscribe(prioritized, "updates")
+	fifo := broker.AddSubscriber()
+	broker.Subscribe(fifo, "updates")
+
+	// The first message is taken by the dispatch loop right away, the others
+	// wait in the queue.
+	broker.Publish("updates", "bulk 1")
+	time.Sleep(10 * time.Millisecond)
+	broker.PublishWithOptions("updates", "bulk 2")
+	broker.PublishWithOptions("updates", "alert", pubsub.WithPriority(pubsub.MaxPriority))
+	broker.PublishWithOptions("updates", "warning", pubsub.WithPriority(5))
+	broker.PublishWithOptions("updates", "bulk 3", pubsub.WithPriority(-1))
+	broker.PublishWithOptions("updates", "alert 2", pubsub.WithPriority(42))
+
+	require.Equal(t, []any{"bulk 1", "alert", "alert 2", "warning", "bulk 2", "bulk 3"}, drain(prioritized))
+	require.Equal(t, []any{"bulk 1", "bulk 2", "alert", "warning", "bulk 3", "alert 2"}, drain(fifo))
+
+	broker.PublishWithOptions("updates", "clamped", pubsub.WithPriority(42))
+	msg := <-prioritized.GetMessages()
+	require.Equal(t, pubsub.MaxPriority, msg.GetPriority())
+	msg = <-fifo.GetMessages()
+	require.Equal(t, pubsub.MaxPriority, msg.GetPriority())
+}
+
+func Test_PriorityDropOldest(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	sub := broker.AddSubscriber(pubsub.SubscriberOptions{
+		Priority:   true,
+		BufferSize: 2,
+		Overflow:   pubsub.OverflowDropOldest,
+	})
+	broker.Subscribe(sub, "updates")
+
+	broker.Publish("updates", "bulk 1")
+	time.Sleep(10 * time.Millisecond)
+	broker.PublishWithOptions("updates", "alert", pubsub.WithPriority(9))
+	broker.PublishWithOptions("updates", "bulk 2", pubsub.WithPriority(1))
+	// A full queue evicts the oldest message of the lowest priority, or the
+	// incoming message when its priority is lower still.
+	broker.PublishWithOptions("updates", "bulk 3")
+	broker.PublishWithOptions("updates", "warning", pubsub.WithPriority(5))
+
+	require.Equal(t, []any{"bulk 1", "alert", "warning"}, drain(sub))
+	require.Equal(t, uint64(2), sub.Dropped())
+}
+
+func Test_PriorityHandler(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	gate := make(chan struct{})
+	received := make(chan any, 10)
+	pubsub.NewHandler(module).ListenWithOptions(func(msg *pubsub.Message) error {
+		<-gate
+		received <- msg.GetContent()
+		return nil
+	}, pubsub.ListenOptions{Topics: []string{"updates"}, Priority: true})
+
+	// The first messages are taken by the handler and the dispatch loop, the
+	// others wait in the queue.
+	for _, content := range []string{"bulk 1", "bulk 2", "bulk 3"} {
+		broker.Publish("updates", content)
+		time.Sleep(10 * time.Millisecond)
+	}
+	broker.PublishWithOptions("updates", "bulk 4")
+	broker.PublishWithOptions("updates", "alert", pubsub.WithPriority(pubsub.MaxPriority))
+	broker.PublishWithOptions("updates", "warning", pubsub.WithPriority(5))
+	close(gate)
+
+	var contents []any
+	for range 6 {
+		contents = append(contents, <-received)
+	}
+	require.Equal(t, []any{"bulk 1", "bulk 2", "bulk 3", "alert", "warning", "bulk 4"}, contents)
+}
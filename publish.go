@@ -0,0 +1,196 @@
+package pubsub
+
+import (
+	"maps"
+	"time"
+)
+
+// PublishOption configures a message published with PublishWithOptions.
+type PublishOption func(m *Message)
+
+// WithHeader sets a header of the message.
+func WithHeader(key string, value string) PublishOption {
+	return func(m *Message) {
+		m.headers[key] = value
+	}
+}
+
+// WithHeaders sets several headers of the message.
+func WithHeaders(headers map[string]string) PublishOption {
+	return func(m *Message) {
+		maps.Copy(m.headers, headers)
+	}
+}
+
+// WithMessageID replaces the ID generated for the message.
+func WithMessageID(id string) PublishOption {
+	return func(m *Message) {
+		m.id = id
+	}
+}
+
+// WithPublisher sets the identifier of the publisher of the message, such as
+// the name of a service.
+func WithPublisher(publisher string) PublishOption {
+	return func(m *Message) {
+		m.publisher = publisher
+	}
+}
+
+// WithCorrelationID sets the ID shared by all the messages of one
+// conversation or workflow.
+func WithCorrelationID(id string) PublishOption {
+	return func(m *Message) {
+		m.correlationID = id
+	}
+}
+
+// WithCausationID sets the ID of the message that caused this one.
+func WithCausationID(id string) PublishOption {
+	return func(m *Message) {
+		m.causationID = id
+	}
+}
+
+// WithCausedBy marks the message as caused by the given one: the causation ID
+// is the ID of the cause, and the correlation ID is inherited from it. A
+// cause without a correlation ID starts a new conversation with its own ID.
+func WithCausedBy(cause *Message) PublishOption {
+	return func(m *Message) {
+		m.causationID = cause.id
+		m.correlationID = cause.correlationID
+		if m.correlationID == "" {
+			m.correlationID = cause.id
+		}
+	}
+}
+
+// WithKey sets the key of the message, such as the ID of the entity it
+// describes. Streams compacting by key keep the latest message of each key.
+func WithKey(key string) PublishOption {
+	return func(m *Message) {
+		m.key = key
+	}
+}
+
+// PublishResult describes a message published with PublishWithOptions.
+type PublishResult struct {
+	// the ID of the published message, or of the original message when it is
+	// deduplicated
+	ID string
+	// the number of subscribers the message was handed to
+	Delivered int
+	// whether the message was dropped as a duplicate of a message published
+	// with the same idempotency key
+	Deduplicated bool
+}
+
+// PublishWithOptions sends the given payload to all subscribers of the
+// specified topic, like TryPublish, with the metadata set by the options.
+//
+// Every published message gets a unique ID and a publish timestamp. The
+// subscribers receive their own copy of the message, with the same metadata.
+//
+// When the broker has a Store, the message is persisted before it is
+// delivered, and the error of the store or its codec is returned.
+//
+// A message with an idempotency key already published to the topic within
+// the dedup window is not published again, see WithIdempotencyKey.
+func (b *Broker) PublishWithOptions(topic string, payload any, opts ...PublishOption) (PublishResult, error) {
+	if b.closed.Load() {
+		return PublishResult{}, ErrBrokerClosed
+	}
+	if err := b.checkTopic(topic, true); err != nil {
+		return PublishResult{}, err
+	}
+
+	msg, err := b.newPublished(topic, payload, opts...)
+	if err != nil {
+		return PublishResult{}, err
+	}
+	return b.publish(msg)
+}
+
+// publish persists, retains and delivers the new message, unless it is a
+// duplicate.
+func (b *Broker) publish(msg *Message) (PublishResult, error) {
+	if msg.idempotencyKey != "" {
+		if id, ok := b.dedup.claim(msg); ok {
+			b.duplicates.Add(1)
+			return PublishResult{ID: id, Deduplicated: true}, nil
+		}
+	}
+
+	b.setExpiry(msg)
+	if b.journal != nil {
+		if err := b.journal.append(msg); err != nil {
+			b.unclaim(msg)
+			return PublishResult{}, err
+		}
+		defer b.journal.published(msg.offset)
+	}
+	if st := b.stream(msg.topic); st != nil {
+		if err := st.append(msg); err != nil {
+			b.unclaim(msg)
+			return PublishResult{}, err
+		}
+	}
+	if msg.retain {
+		b.retain(msg)
+	}
+
+	return PublishResult{ID: msg.id, Delivered: b.deliver(msg)}, nil
+}
+
+// unclaim releases the idempotency key of a message that failed to publish.
+func (b *Broker) unclaim(msg *Message) {
+	if msg.idempotencyKey != "" {
+		b.dedup.release(msg)
+	}
+}
+
+// deliver hands a copy of the message to each active recipient and returns
+// how many received one.
+func (b *Broker) deliver(msg *Message) int {
+	b.mutex.RLock()
+	subscribers, groups := b.recipients(msg)
+	b.mutex.RUnlock()
+
+	delivered := 0
+	for _, s := range subscribers {
+		if !s.IsActive() {
+			continue
+		}
+
+		m := msg.clone()
+		m.group = groups[s.ID]
+		if b.journal != nil {
+			m.ticket = b.journal.ticket(msg.offset, s.durable)
+		}
+		delivered++
+		if s.durable != nil && !s.durable.admit(m) {
+			continue
+		}
+		b.signal(s, m)
+	}
+	return delivered
+}
+
+// newPublished returns a new message with a generated ID and the current
+// time as publish timestamp, configured by the options.
+func (b *Broker) newPublished(topic string, payload any, opts ...PublishOption) (*Message, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := NewMessage(topic, payload)
+	msg.id = id
+	msg.publishedAt = time.Now()
+	msg.headers = map[string]string{}
+	msg.broker = b
+	for _, opt := range opts {
+		opt(msg)
+	}
+	return msg, nil
+}
@@ -0,0 +1,104 @@
+package pubsub_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_PublishWithOptions(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	first := broker.AddSubscriber()
+	second := broker.AddSubscriber()
+	broker.Subscribe(first, "orders")
+	broker.Subscribe(second, "orders")
+
+	before := time.Now()
+	result, err := broker.PublishWithOptions("orders", "created",
+		pubsub.WithPublisher("checkout"),
+		pubsub.WithHeader("tenant", "acme"),
+		pubsub.WithHeaders(map[string]string{"region": "eu"}),
+		pubsub.WithCorrelationID("order-1"),
+		pubsub.WithCausationID("cart-1"),
+	)
+	require.Nil(t, err)
+	require.NotEmpty(t, result.ID)
+	require.Equal(t, 2, result.Delivered)
+
+	for _, sub := range []*pubsub.Subscriber{first, second} {
+		msg := <-sub.GetMessages()
+		require.Equal(t, result.ID, msg.GetID())
+		require.Equal(t, "created", msg.GetContent())
+		require.Equal(t, "checkout", msg.GetPublisher())
+		require.Equal(t, "acme", msg.GetHeader("tenant"))
+		require.Equal(t, map[string]string{"tenant": "acme", "region": "eu"}, msg.GetHeaders())
+		require.Equal(t, "order-1", msg.GetCorrelationID())
+		require.Equal(t, "cart-1", msg.GetCausationID())
+		require.False(t, msg.GetPublishedAt().Before(before))
+	}
+
+	other, err := broker.PublishWithOptions("orders", "paid", pubsub.WithMessageID("paid-1"))
+	require.Nil(t, err)
+	require.Equal(t, "paid-1", other.ID)
+	require.Equal(t, "paid-1", (<-first.GetMessages()).GetID())
+
+	_, err = broker.PublishWithOptions("", "nothing")
+	require.ErrorIs(t, err, pubsub.ErrInvalidTopic)
+}
+
+func Test_PublishUniqueIDs(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	broker.Publish("orders", 1)
+	broker.Publish("orders", 2)
+
+	first, second := <-sub.GetMessages(), <-sub.GetMessages()
+	require.NotEmpty(t, first.GetID())
+	require.NotEqual(t, first.GetID(), second.GetID())
+}
+
+func Test_WithCausedBy(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+	broker.Subscribe(sub, "invoices")
+
+	broker.Publish("orders", "created")
+	order := <-sub.GetMessages()
+
+	_, err := broker.PublishWithOptions("invoices", "issued", pubsub.WithCausedBy(order))
+	require.Nil(t, err)
+	invoice := <-sub.GetMessages()
+	require.Equal(t, order.GetID(), invoice.GetCausationID())
+	require.Equal(t, order.GetID(), invoice.GetCorrelationID())
+
+	_, err = broker.PublishWithOptions("orders", "sent", pubsub.WithCausedBy(invoice))
+	require.Nil(t, err)
+	sent := <-sub.GetMessages()
+	require.Equal(t, invoice.GetID(), sent.GetCausationID())
+	require.Equal(t, order.GetID(), sent.GetCorrelationID())
+}
+
+func Test_RedeliveryKeepsMetadata(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{AtLeastOnce: true})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "orders")
+
+	result, err := broker.PublishWithOptions("orders", "created", pubsub.WithHeader("tenant", "acme"))
+	require.Nil(t, err)
+
+	msg := <-sub.GetMessages()
+	msg.Nack(true)
+	retried := <-sub.GetMessages()
+	require.Equal(t, result.ID, retried.GetID())
+	require.Equal(t, "acme", retried.GetHeader("tenant"))
+	require.Equal(t, 2, retried.GetAttempts())
+	retried.Ack()
+}
@@ -0,0 +1,197 @@
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+// queue is the bounded FIFO of messages waiting to be dispatched to an
+// ordered subscriber. A priority queue keeps one FIFO per priority and pops
+// the highest priority first, a plain queue has a single FIFO.
+type queue struct {
+	mutex  sync.Mutex
+	levels [][]*Message // FIFO of the waiting messages per priority
+	count  int          // Number of waiting messages
+	size   int
+	taken  int           // Popped messages not received by the subscriber yet
+	ready  chan struct{} // Signalled when a message is pushed
+	space  chan struct{} // Signalled when a message is popped
+}
+
+func newQueue(size int, priority bool) *queue {
+	levels := 1
+	if priority {
+		levels = MaxPriority + 1
+	}
+	return &queue{
+		levels: make([][]*Message, levels),
+		size:   size,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+}
+
+// notify wakes up one waiter of the given channel without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push appends the message to the queue. It reports false when the queue is
+// full.
+func (q *queue) push(msg *Message) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.count >= q.size {
+		return false
+	}
+	q.add(msg)
+	notify(q.ready)
+	return true
+}
+
+// pushEvict appends the message to the queue, evicting the oldest message of
+// the lowest priority when the queue is full. The evicted message is returned,
+// it is the given message when its priority is lower than all the others.
+func (q *queue) pushEvict(msg *Message) *Message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var evicted *Message
+	if q.count >= q.size {
+		level := q.lowest()
+		if level > q.level(msg) {
+			return msg
+		}
+		evicted = q.take(level)
+	}
+	q.add(msg)
+	notify(q.ready)
+	return evicted
+}
+
+// pushWait appends the message to the queue, waiting for free space up to the
+// given timeout. A zero timeout waits until done is closed. It reports false
+// when the message could not be queued.
+func (q *queue) pushWait(msg *Message, timeout time.Duration, done <-chan struct{}) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for !q.push(msg) {
+		select {
+		case <-q.space:
+		case <-expired:
+			return false
+		case <-done:
+			return false
+		}
+	}
+	return true
+}
+
+// pop removes and returns the oldest message of the highest priority, waiting
+// for one to be pushed. It reports false when done is closed first. The
+// message still counts as queued until sent is called.
+func (q *queue) pop(done <-chan struct{}) (*Message, bool) {
+	for {
+		q.mutex.Lock()
+		if q.count > 0 {
+			msg := q.take(q.highest())
+			q.taken++
+			q.mutex.Unlock()
+			notify(q.space)
+			return msg, true
+		}
+		q.mutex.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+// clear removes and returns the messages waiting in the queue.
+func (q *queue) clear() []*Message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items := make([]*Message, 0, q.count)
+	for level := len(q.levels) - 1; level >= 0; level-- {
+		items = append(items, q.levels[level]...)
+		q.levels[level] = nil
+	}
+	q.count = 0
+	return items
+}
+
+// sent marks a popped message as received by the subscriber.
+func (q *queue) sent() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.taken--
+}
+
+// len returns the number of messages waiting in the queue, including popped
+// messages not received yet.
+func (q *queue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.count + q.taken
+}
+
+// level returns the FIFO of the queue holding the message.
+func (q *queue) level(msg *Message) int {
+	if len(q.levels) == 1 {
+		return 0
+	}
+	return msg.priority
+}
+
+// add appends the message to its FIFO. The caller must hold the mutex.
+func (q *queue) add(msg *Message) {
+	level := q.level(msg)
+	q.levels[level] = append(q.levels[level], msg)
+	q.count++
+}
+
+// take removes and returns the oldest message of the given non-empty FIFO.
+// The caller must hold the mutex.
+func (q *queue) take(level int) *Message {
+	items := q.levels[level]
+	msg := items[0]
+	items[0] = nil
+	q.levels[level] = items[1:]
+	q.count--
+	return msg
+}
+
+// highest returns the highest non-empty FIFO of a non-empty queue. The caller
+// must hold the mutex.
+func (q *queue) highest() int {
+	level := len(q.levels) - 1
+	for len(q.levels[level]) == 0 {
+		level--
+	}
+	return level
+}
+
+// lowest returns the lowest non-empty FIFO of a non-empty queue. The caller
+// must hold the mutex.
+func (q *queue) lowest() int {
+	level := 0
+	for len(q.levels[level]) == 0 {
+		level++
+	}
+	return level
+}
@@ -0,0 +1,139 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ReplyToHeader is the header holding the topic the replies to a request
+	// are published to.
+	ReplyToHeader = "reply-to"
+	// ErrorHeader is the header holding the error a responder failed with.
+	ErrorHeader = "error"
+	// InboxPrefix is the first segment of the private topics receiving the
+	// replies to requests.
+	InboxPrefix = "_INBOX"
+)
+
+// ReplyError is the error a responder failed with, returned by Request.
+type ReplyError struct {
+	// the reply carrying the error
+	Reply *Message
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("pubsub: responder failed: %s", e.Reply.GetHeader(ErrorHeader))
+}
+
+// Request publishes the payload to the specified topic and waits for the
+// first reply.
+//
+// The request is published with the ReplyToHeader set to a private inbox
+// topic, where a responder publishes its reply with Message.Reply. Request
+// returns ErrNoResponders when the topic has no subscribers, the error of the
+// context when it is done before a reply arrives, and a ReplyError when the
+// responder replied with an error. The errors of TryAddSubscriber and
+// PublishWithOptions are returned as well.
+func (b *Broker) Request(ctx context.Context, topic string, payload any, opts ...PublishOption) (*Message, error) {
+	inbox, err := b.newInbox()
+	if err != nil {
+		return nil, err
+	}
+	defer b.RemoveSubscriber(inbox.sub)
+
+	opts = append(opts, WithHeader(ReplyToHeader, inbox.topic))
+	result, err := b.PublishWithOptions(topic, payload, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if result.Delivered == 0 {
+		return nil, ErrNoResponders
+	}
+
+	select {
+	case reply, ok := <-inbox.sub.GetMessages():
+		if !ok {
+			return nil, ErrBrokerClosed
+		}
+		reply.Ack()
+		if reply.GetHeader(ErrorHeader) != "" {
+			return reply, &ReplyError{Reply: reply}
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type inbox struct {
+	topic string
+	sub   *Subscriber
+}
+
+// newInbox adds a subscriber to a new private inbox topic.
+func (b *Broker) newInbox() (*inbox, error) {
+	sub, err := b.TryAddSubscriber()
+	if err != nil {
+		return nil, err
+	}
+	topic := InboxPrefix + b.opt.Delimiter + sub.ID
+	if err := b.TrySubscribe(sub, topic); err != nil {
+		b.RemoveSubscriber(sub)
+		return nil, err
+	}
+	return &inbox{topic: topic, sub: sub}, nil
+}
+
+// Reply publishes the payload to the reply-to topic of the message, caused by
+// the message. It returns ErrNoReplyTo when the message is not a request and
+// ErrBrokerNotFound when it was not published to a broker.
+func (m *Message) Reply(payload any, opts ...PublishOption) error {
+	replyTo := m.GetHeader(ReplyToHeader)
+	if replyTo == "" {
+		return ErrNoReplyTo
+	}
+	if m.broker == nil {
+		return ErrBrokerNotFound
+	}
+
+	opts = append([]PublishOption{WithCausedBy(m)}, opts...)
+	_, err := m.broker.PublishWithOptions(replyTo, payload, opts...)
+	return err
+}
+
+// RespondFnc handles a request and returns the payload of the reply.
+type RespondFnc func(msg *Message) (any, error)
+
+// Respond subscribes the handler to the topic and replies to every request
+// received with the payload returned by factory. When factory fails, the
+// reply carries the error in the ErrorHeader, and Request returns it as a
+// ReplyError. Messages that are not requests are ignored.
+//
+// Respond panics when the handler cannot subscribe; use TryRespond to get the
+// error instead.
+func (h *Handler) Respond(topic string, factory RespondFnc) {
+	if err := h.TryRespond(topic, factory); err != nil {
+		panic(err)
+	}
+}
+
+// TryRespond works like Respond, but returns the error that prevented the
+// handler from subscribing to the topic.
+func (h *Handler) TryRespond(topic string, factory RespondFnc) error {
+	return h.TryListenWithOptions(func(msg *Message) error {
+		if msg.GetHeader(ReplyToHeader) == "" {
+			return nil
+		}
+		payload, err := factory(msg)
+		if err != nil {
+			var panicked *PanicError
+			if errors.As(err, &panicked) {
+				return err
+			}
+			return msg.Reply(nil, WithHeader(ErrorHeader, err.Error()))
+		}
+		return msg.Reply(payload)
+	}, ListenOptions{Topics: []string{topic}})
+}
@@ -0,0 +1,77 @@
+package pubsub_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+func Test_Request(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{Wildcard: true})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	handler := pubsub.NewHandler(module)
+	handler.Respond("prices.quote", func(msg *pubsub.Message) (any, error) {
+		if msg.GetContent() == "unknown" {
+			return nil, errors.New("unknown symbol")
+		}
+		return msg.GetContent().(string) + ":100", nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := broker.Request(ctx, "prices.quote", "BTC", pubsub.WithCorrelationID("quote-1"))
+	require.Nil(t, err)
+	require.Equal(t, "BTC:100", reply.GetContent())
+	require.Equal(t, "quote-1", reply.GetCorrelationID())
+	require.NotEmpty(t, reply.GetCausationID())
+
+	reply, err = broker.Request(ctx, "prices.quote", "unknown")
+	var replyErr *pubsub.ReplyError
+	require.ErrorAs(t, err, &replyErr)
+	require.Same(t, reply, replyErr.Reply)
+	require.Equal(t, "pubsub: responder failed: unknown symbol", err.Error())
+
+	_, err = broker.Request(ctx, "prices.other", "BTC")
+	require.ErrorIs(t, err, pubsub.ErrNoResponders)
+
+	// Only the responder is left once the inboxes are removed.
+	require.Eventually(t, func() bool {
+		return broker.GetSubscribers("prices.quote") == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func Test_RequestTimeout(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	silent := broker.AddSubscriber()
+	broker.Subscribe(silent, "jobs")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := broker.Request(ctx, "jobs", "run")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	request := <-silent.GetMessages()
+	require.NotEmpty(t, request.GetHeader(pubsub.ReplyToHeader))
+	require.Nil(t, request.Reply("late"))
+}
+
+func Test_ReplyWithoutRequest(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "jobs")
+	broker.Publish("jobs", "run")
+
+	msg := <-sub.GetMessages()
+	require.ErrorIs(t, msg.Reply("done"), pubsub.ErrNoReplyTo)
+}
@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+type retainStore struct {
+	mutex    sync.RWMutex
+	messages map[string]*Message
+}
+
+func newRetainStore() *retainStore {
+	return &retainStore{messages: map[string]*Message{}}
+}
+
+// WithRetain keeps the message as the last value of its topic. The retained
+// message is delivered to every subscriber subscribing to the topic later,
+// until another retained message replaces it. A retained message with a nil
+// payload clears the last value of the topic instead.
+func WithRetain() PublishOption {
+	return func(m *Message) {
+		m.retain = true
+	}
+}
+
+// IsRetained reports whether the message was published with WithRetain.
+func (m *Message) IsRetained() bool {
+	return m.retain
+}
+
+// retain stores the message as the last value of its topic, or clears the
+// last value when the message has no content.
+func (b *Broker) retain(m *Message) {
+	b.retained.mutex.Lock()
+	defer b.retained.mutex.Unlock()
+
+	if m.content == nil {
+		delete(b.retained.messages, m.topic)
+		return
+	}
+	b.retained.messages[m.topic] = m
+}
+
+// Retained returns the retained message of the given topic, without
+// subscribing to it. An expired message is not returned.
+func (b *Broker) Retained(topic string) (*Message, bool) {
+	b.retained.mutex.RLock()
+	defer b.retained.mutex.RUnlock()
+
+	m, ok := b.retained.messages[topic]
+	if !ok || m.IsExpired() {
+		return nil, false
+	}
+	return m.clone(), true
+}
+
+// ClearRetained forgets the retained message of the given topic. It reports
+// false when the topic has no retained message.
+func (b *Broker) ClearRetained(topic string) bool {
+	b.retained.mutex.Lock()
+	defer b.retained.mutex.Unlock()
+
+	if _, ok := b.retained.messages[topic]; !ok {
+		return false
+	}
+	delete(b.retained.messages, topic)
+	return true
+}
+
+// deliverRetained hands the retained messages of the topics matching a new
+// subscription to the subscriber, in topic order. Expired messages are
+// skipped.
+func (b *Broker) deliverRetained(s *Subscriber, match func(topic string) bool) {
+	b.retained.mutex.RLock()
+	var messages []*Message
+	for topic, m := range b.retained.messages {
+		if match(topic) && !m.IsExpired() {
+			messages = append(messages, m)
+		}
+	}
+	b.retained.mutex.RUnlock()
+
+	slices.SortFunc(messages, func(x, y *Message) int {
+		return strings.Compare(x.topic, y.topic)
+	})
+	for _, m := range messages {
+		if !s.IsActive() {
+			return
+		}
+		b.signal(s, m.clone())
+	}
+}
+
+// topicMatcher returns a predicate matching the published topics delivered
+// to a subscription of the given topic.
+func (b *Broker) topicMatcher(topic string) func(string) bool {
+	if b.trie == nil {
+		return func(published string) bool {
+			return published == topic
+		}
+	}
+
+	trie := newTopicTrie(b.opt.Delimiter)
+	trie.insert(topic)
+	return func(published string) bool {
+		return len(trie.match(published)) > 0
+	}
+}
@@ -0,0 +1,75 @@
+package pubsub_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_Retain(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	_, err := broker.PublishWithOptions("prices", 100, pubsub.WithRetain())
+	require.Nil(t, err)
+	_, err = broker.PublishWithOptions("prices", 101, pubsub.WithRetain())
+	require.Nil(t, err)
+	broker.Publish("prices", 102)
+
+	retained, ok := broker.Retained("prices")
+	require.True(t, ok)
+	require.Equal(t, 101, retained.GetContent())
+	require.True(t, retained.IsRetained())
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "prices")
+	msg := <-sub.GetMessages()
+	require.Equal(t, 101, msg.GetContent())
+	require.True(t, msg.IsRetained())
+
+	// Subscribing again does not deliver the retained message twice.
+	broker.Subscribe(sub, "prices")
+	require.Empty(t, drain(sub))
+
+	_, err = broker.PublishWithOptions("prices", nil, pubsub.WithRetain())
+	require.Nil(t, err)
+	require.Nil(t, (<-sub.GetMessages()).GetContent())
+	_, ok = broker.Retained("prices")
+	require.False(t, ok)
+
+	broker.Publish("rates", 1)
+	_, err = broker.PublishWithOptions("rates", 2, pubsub.WithRetain())
+	require.Nil(t, err)
+	require.True(t, broker.ClearRetained("rates"))
+	require.False(t, broker.ClearRetained("rates"))
+
+	late := broker.AddSubscriber()
+	broker.Subscribe(late, "rates")
+	require.Empty(t, drain(late))
+}
+
+func Test_RetainWildcard(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{Wildcard: true})
+
+	for topic, price := range map[string]int{"prices.btc": 1, "prices.eth": 2, "rates.eur": 3} {
+		_, err := broker.PublishWithOptions(topic, price, pubsub.WithRetain())
+		require.Nil(t, err)
+	}
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "prices.*")
+	require.Equal(t, []any{1, 2}, drain(sub))
+
+	all := broker.AddSubscriber()
+	broker.Subscribe(all, "#")
+	require.Equal(t, []any{1, 2, 3}, drain(all))
+
+	pattern := broker.AddSubscriber()
+	broker.SubscribePattern(pattern, regexp.MustCompile(`^rates\.`))
+	require.Equal(t, []any{3}, drain(pattern))
+
+	member := broker.AddSubscriber()
+	broker.SubscribeGroup(member, "prices.btc", "workers")
+	require.Empty(t, drain(member))
+}
@@ -0,0 +1,194 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Store persists published messages as an append-only log of records.
+//
+// Records are numbered by increasing offsets assigned by Append. The broker
+// appends every published message before delivering it and truncates the log
+// once the messages are delivered, so the records left in the store when the
+// broker restarts are the messages that were not delivered.
+type Store interface {
+	// Append adds the record to the end of the log and returns its offset.
+	Append(record *Record) (uint64, error)
+	// Read returns up to limit records starting at the given offset, oldest
+	// first. A limit of zero or less returns every record.
+	Read(offset uint64, limit int) ([]*Record, error)
+	// Truncate removes the records before the given offset.
+	Truncate(offset uint64) error
+	// Close flushes and releases the store.
+	Close() error
+}
+
+// Compacter is implemented by the stores able to remove records from the
+// middle of their log, as the streams compacting by key require.
+type Compacter interface {
+	// Compact removes the records for which drop returns true. A store may
+	// keep its most recent records without calling drop for them.
+	Compact(drop func(record *Record) bool) error
+}
+
+// Record is a message persisted in a Store.
+type Record struct {
+	Offset         uint64            `json:"offset"`
+	Topic          string            `json:"topic"`
+	ID             string            `json:"id"`
+	PublishedAt    time.Time         `json:"published_at"`
+	Publisher      string            `json:"publisher,omitempty"`
+	CorrelationID  string            `json:"correlation_id,omitempty"`
+	CausationID    string            `json:"causation_id,omitempty"`
+	Key            string            `json:"key,omitempty"`
+	Priority       int               `json:"priority,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Retain         bool              `json:"retain,omitempty"`
+	TTL            time.Duration     `json:"ttl,omitempty"`
+	Payload        []byte            `json:"payload"`
+}
+
+// Codec encodes the payloads of the messages persisted in a Store.
+type Codec interface {
+	// Marshal encodes the payload of a message published to the topic.
+	Marshal(topic string, payload any) ([]byte, error)
+	// Unmarshal decodes the payload of a message published to the topic.
+	Unmarshal(topic string, data []byte) (any, error)
+}
+
+// JSONCodec encodes payloads as JSON.
+//
+// Payloads of the topics listed in Types are decoded to values of the given
+// type. Other payloads are decoded to the generic JSON types: maps, slices,
+// strings, float64 and bool.
+type JSONCodec struct {
+	Types map[string]reflect.Type
+}
+
+func (c JSONCodec) Marshal(topic string, payload any) ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (c JSONCodec) Unmarshal(topic string, data []byte) (any, error) {
+	typ, ok := c.Types[topic]
+	if !ok {
+		var payload any
+		err := json.Unmarshal(data, &payload)
+		return payload, err
+	}
+
+	value := reflect.New(typ)
+	if err := json.Unmarshal(data, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+// MemoryStore is a Store keeping the records in memory. It does not survive
+// a restart, but is useful in tests and as a reference implementation.
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	first       uint64 // Offset of records[0]
+	records     []*Record
+	checkpoints map[string]Checkpoint
+	scheduled   []*ScheduledRecord
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Append(record *Record) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored := *record
+	stored.Offset = s.first + uint64(len(s.records))
+	s.records = append(s.records, &stored)
+	return stored.Offset, nil
+}
+
+func (s *MemoryStore) Read(offset uint64, limit int) ([]*Record, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	start := int(max(offset, s.first) - s.first)
+	if start >= len(s.records) {
+		return nil, nil
+	}
+	end := len(s.records)
+	if limit > 0 {
+		end = min(end, start+limit)
+	}
+	return slices.Clone(s.records[start:end]), nil
+}
+
+func (s *MemoryStore) Truncate(offset uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if offset <= s.first {
+		return nil
+	}
+	n := min(int(offset-s.first), len(s.records))
+	s.records = slices.Delete(s.records, 0, n)
+	s.first += uint64(n)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) SaveCheckpoints(checkpoints map[string]Checkpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.checkpoints = maps.Clone(checkpoints)
+	return nil
+}
+
+func (s *MemoryStore) LoadCheckpoints() (map[string]Checkpoint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	checkpoints := maps.Clone(s.checkpoints)
+	if checkpoints == nil {
+		checkpoints = map[string]Checkpoint{}
+	}
+	return checkpoints, nil
+}
+
+func (s *MemoryStore) AddScheduled(record *ScheduledRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.scheduled = slices.DeleteFunc(s.scheduled, func(saved *ScheduledRecord) bool {
+		return saved.ID == record.ID
+	})
+	s.scheduled = append(s.scheduled, record)
+	return nil
+}
+
+func (s *MemoryStore) RemoveScheduled(ids ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.scheduled = slices.DeleteFunc(s.scheduled, func(saved *ScheduledRecord) bool {
+		return slices.Contains(ids, saved.ID)
+	})
+	return nil
+}
+
+func (s *MemoryStore) LoadScheduled() ([]*ScheduledRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return slices.Clone(s.scheduled), nil
+}
@@ -0,0 +1,314 @@
+package pubsub_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func appendRecords(t *testing.T, store pubsub.Store, topic string, n int) {
+	for i := 0; i < n; i++ {
+		_, err := store.Append(&pubsub.Record{Topic: topic, Payload: []byte("1")})
+		require.Nil(t, err)
+	}
+}
+
+func offsets(records []*pubsub.Record) []uint64 {
+	result := []uint64{}
+	for _, record := range records {
+		result = append(result, record.Offset)
+	}
+	return result
+}
+
+func Test_MemoryStore(t *testing.T) {
+	store := pubsub.NewMemoryStore()
+	appendRecords(t, store, "orders", 5)
+
+	records, err := store.Read(1, 2)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{1, 2}, offsets(records))
+
+	require.Nil(t, store.Truncate(3))
+	records, err = store.Read(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{3, 4}, offsets(records))
+
+	offset, err := store.Append(&pubsub.Record{Topic: "orders"})
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), offset)
+	require.Nil(t, store.Close())
+}
+
+func Test_FileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := pubsub.OpenFileStore(dir, pubsub.FileStoreOptions{SegmentSize: 200})
+	require.Nil(t, err)
+
+	offset, err := store.Append(&pubsub.Record{
+		Topic:   "orders",
+		ID:      "order-1",
+		Headers: map[string]string{"tenant": "acme"},
+		Payload: []byte(`"created"`),
+	})
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), offset)
+	appendRecords(t, store, "orders", 9)
+
+	records, err := store.Read(0, 1)
+	require.Nil(t, err)
+	require.Equal(t, "order-1", records[0].ID)
+	require.Equal(t, "acme", records[0].Headers["tenant"])
+	require.Equal(t, []byte(`"created"`), records[0].Payload)
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	require.Nil(t, err)
+	require.Greater(t, len(segments), 1)
+
+	require.Nil(t, store.Truncate(6))
+	records, err = store.Read(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{6, 7, 8, 9}, offsets(records))
+	remaining, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	require.Nil(t, err)
+	require.Less(t, len(remaining), len(segments))
+	require.Nil(t, store.Close())
+
+	_, err = store.Append(&pubsub.Record{Topic: "orders"})
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	// The records and the truncation survive a restart.
+	store, err = pubsub.OpenFileStore(dir, pubsub.FileStoreOptions{SegmentSize: 200})
+	require.Nil(t, err)
+	records, err = store.Read(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{6, 7, 8, 9}, offsets(records))
+	offset, err = store.Append(&pubsub.Record{Topic: "orders"})
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), offset)
+	require.Nil(t, store.Close())
+}
+
+func Test_FileStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := pubsub.OpenFileStore(dir, pubsub.FileStoreOptions{Sync: pubsub.SyncNever})
+	require.Nil(t, err)
+	appendRecords(t, store, "orders", 3)
+	require.Nil(t, store.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	require.Nil(t, err)
+	require.Len(t, segments, 1)
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	require.Nil(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 42, 1, 2})
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	store, err = pubsub.OpenFileStore(dir)
+	require.Nil(t, err)
+	records, err := store.Read(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offsets(records))
+
+	offset, err := store.Append(&pubsub.Record{Topic: "orders"})
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), offset)
+	records, err = store.Read(3, 0)
+	require.Nil(t, err)
+	require.Len(t, records, 1)
+	require.Nil(t, store.Close())
+
+	// A corrupt length larger than the file is cut off too.
+	file, err = os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	require.Nil(t, err)
+	_, err = file.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, 1, 2, 3})
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	store, err = pubsub.OpenFileStore(dir)
+	require.Nil(t, err)
+	records, err = store.Read(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3}, offsets(records))
+	require.Nil(t, store.Close())
+}
+
+func Test_FileStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	store, err := pubsub.OpenFileStore(dir, pubsub.FileStoreOptions{SegmentSize: 200})
+	require.Nil(t, err)
+	appendRecords(t, store, "orders", 10)
+
+	// Odd records are dropped, and segments left empty are deleted.
+	var dropped []uint64
+	require.Nil(t, store.Compact(func(record *pubsub.Record) bool {
+		if record.Offset%2 == 1 || record.Offset < 4 {
+			dropped = append(dropped, record.Offset)
+			return true
+		}
+		return false
+	}))
+	records, err := store.Read(0, 0)
+	require.Nil(t, err)
+	kept := offsets(records)
+	require.NotContains(t, kept, uint64(0))
+	require.NotContains(t, kept, uint64(5))
+	require.Contains(t, kept, uint64(9), "the active segment is not rewritten")
+	require.Len(t, kept, 10-len(dropped))
+	require.Nil(t, store.Close())
+
+	store, err = pubsub.OpenFileStore(dir, pubsub.FileStoreOptions{SegmentSize: 200})
+	require.Nil(t, err)
+	records, err = store.Read(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, kept, offsets(records))
+	offset, err := store.Append(&pubsub.Record{Topic: "orders"})
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), offset)
+	require.Nil(t, store.Close())
+}
+
+func Test_FileStoreScheduled(t *testing.T) {
+	dir := t.TempDir()
+	store, err := pubsub.OpenFileStore(dir)
+	require.Nil(t, err)
+
+	add := func(id string, payload string) {
+		require.Nil(t, store.AddScheduled(&pubsub.ScheduledRecord{
+			Record:    pubsub.Record{ID: id, Topic: "orders", Payload: []byte(payload)},
+			DeliverAt: time.Now().Add(time.Hour),
+		}))
+	}
+	ids := func() []string {
+		records, err := store.LoadScheduled()
+		require.Nil(t, err)
+		ids := []string{}
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+		return ids
+	}
+	size := func() int64 {
+		info, err := os.Stat(filepath.Join(dir, "SCHEDULED"))
+		require.Nil(t, err)
+		return info.Size()
+	}
+
+	for i := range 200 {
+		add(fmt.Sprintf("m%03d", i), `"created"`)
+	}
+	full := size()
+
+	// Removing messages appends to the log, which is rewritten once most of
+	// its entries are removed messages.
+	for i := range 190 {
+		require.Nil(t, store.RemoveScheduled(fmt.Sprintf("m%03d", i)))
+	}
+	require.Nil(t, store.RemoveScheduled("unknown"))
+	require.Less(t, size(), full/4)
+
+	// A message added again replaces the saved one.
+	add("m195", `"updated"`)
+	expected := []string{"m190", "m191", "m192", "m193", "m194", "m196", "m197", "m198", "m199", "m195"}
+	require.Equal(t, expected, ids())
+	require.Nil(t, store.Close())
+
+	file, err := os.OpenFile(filepath.Join(dir, "SCHEDULED"), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.Nil(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 42, 1, 2})
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	store, err = pubsub.OpenFileStore(dir)
+	require.Nil(t, err)
+	require.Equal(t, expected, ids())
+	records, err := store.LoadScheduled()
+	require.Nil(t, err)
+	require.Equal(t, `"updated"`, string(records[len(records)-1].Payload))
+	require.Nil(t, store.RemoveScheduled(expected...))
+	require.Empty(t, ids())
+	require.Nil(t, store.Close())
+}
+
+func Test_FileStoreSyncInterval(t *testing.T) {
+	dir := t.TempDir()
+	opt := pubsub.FileStoreOptions{Sync: pubsub.SyncInterval, SyncInterval: 5 * time.Millisecond}
+	store, err := pubsub.OpenFileStore(dir, opt)
+	require.Nil(t, err)
+
+	// The records are flushed in the background while the store is idle.
+	appendRecords(t, store, "orders", 3)
+	time.Sleep(20 * time.Millisecond)
+	appendRecords(t, store, "orders", 2)
+	require.Nil(t, store.Close())
+	require.Nil(t, store.Close())
+
+	store, err = pubsub.OpenFileStore(dir, opt)
+	require.Nil(t, err)
+	records, err := store.Read(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, offsets(records))
+	require.Nil(t, store.Close())
+}
+
+func Test_FileStoreIndex(t *testing.T) {
+	dir := t.TempDir()
+	opt := pubsub.FileStoreOptions{SegmentSize: 32 << 10}
+	store, err := pubsub.OpenFileStore(dir, opt)
+	require.Nil(t, err)
+	appendRecords(t, store, "orders", 1000)
+
+	// Reads seek to the indexed position closest to the offset, in every
+	// segment, whether the index was built by Append or when opening.
+	check := func(store *pubsub.FileStore) {
+		for _, offset := range []uint64{0, 1, 37, 300, 512, 733, 990} {
+			records, err := store.Read(offset, 10)
+			require.Nil(t, err)
+			expected := []uint64{}
+			for i := offset; i < min(offset+10, 1000); i++ {
+				expected = append(expected, i)
+			}
+			require.Equal(t, expected, offsets(records), offset)
+		}
+	}
+	check(store)
+	require.Nil(t, store.Close())
+
+	store, err = pubsub.OpenFileStore(dir, opt)
+	require.Nil(t, err)
+	check(store)
+
+	require.Nil(t, store.Compact(func(record *pubsub.Record) bool {
+		return record.Offset < 200 && record.Offset%2 == 1
+	}))
+	records, err := store.Read(101, 3)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{102, 104, 106}, offsets(records))
+	records, err = store.Read(199, 3)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{200, 201, 202}, offsets(records))
+	require.Nil(t, store.Close())
+}
+
+func Test_JSONCodec(t *testing.T) {
+	codec := pubsub.JSONCodec{Types: map[string]reflect.Type{
+		"prices": reflect.TypeFor[Price](),
+	}}
+
+	data, err := codec.Marshal("prices", Price{Symbol: "BTC", Value: 1})
+	require.Nil(t, err)
+	payload, err := codec.Unmarshal("prices", data)
+	require.Nil(t, err)
+	require.Equal(t, Price{Symbol: "BTC", Value: 1}, payload)
+
+	payload, err = codec.Unmarshal("other", data)
+	require.Nil(t, err)
+	require.Equal(t, map[string]any{"Symbol": "BTC", "Value": float64(1)}, payload)
+}
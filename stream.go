@@ -0,0 +1,675 @@
+package pubsub
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCompactInterval is how often a stream compacting by key is
+// compacted, when neither an interval nor a threshold is configured.
+const DefaultCompactInterval = time.Minute
+
+// streamBatch is how many messages a stream consumer reads at once.
+const streamBatch = 256
+
+type StreamOptions struct {
+	// the maximum number of messages kept, zero keeps every message
+	MaxMessages int
+	// the maximum size of the payloads kept, in bytes encoded by Codec, zero
+	// keeps every message
+	MaxBytes int64
+	// how long messages are kept, zero keeps them forever
+	MaxAge time.Duration
+	// where the messages are kept, nil keeps them in memory
+	Store Store
+	// encodes the payloads to measure and store them, defaults to JSONCodec
+	Codec Codec
+	// keeps only the latest message of each key, see CompactStream
+	Compact bool
+	// how often the stream is compacted, defaults to DefaultCompactInterval
+	// when no CompactThreshold is set
+	CompactInterval time.Duration
+	// compacts the stream once this many messages were appended since the
+	// last compaction
+	CompactThreshold int
+	// how long the compaction keeps tombstones, so that consumers behind see
+	// the deletion of the key, zero removes them at the next compaction
+	TombstoneRetention time.Duration
+}
+
+// StreamInfo describes the messages kept by a stream.
+type StreamInfo struct {
+	Topic     string
+	First     uint64 // Offset of the oldest message kept
+	Next      uint64 // Offset of the next message
+	Messages  int
+	Bytes     int64
+	Consumers int
+}
+
+type startKind int
+
+const (
+	startLatest startKind = iota
+	startEarliest
+	startOffset
+	startTime
+)
+
+// StartPosition is where a stream consumer starts reading.
+type StartPosition struct {
+	kind   startKind
+	offset uint64
+	time   time.Time
+}
+
+// StartLatest starts reading with the next message published to the stream.
+func StartLatest() StartPosition {
+	return StartPosition{kind: startLatest}
+}
+
+// StartEarliest starts reading with the oldest message kept by the stream.
+func StartEarliest() StartPosition {
+	return StartPosition{kind: startEarliest}
+}
+
+// StartAtOffset starts reading with the message at the given offset, or with
+// the oldest message kept when it was removed by the retention.
+func StartAtOffset(offset uint64) StartPosition {
+	return StartPosition{kind: startOffset, offset: offset}
+}
+
+// StartAtTime starts reading with the first message published at or after
+// the given time.
+func StartAtTime(t time.Time) StartPosition {
+	return StartPosition{kind: startTime, time: t}
+}
+
+type stream struct {
+	topic     string
+	opt       StreamOptions
+	mutex     sync.Mutex
+	entries   []streamEntry
+	next      uint64
+	bytes     int64
+	appended  chan struct{} // Closed when a message is appended
+	consumers map[string]chan struct{}
+	appends   int // Messages appended since the last compaction
+	compactor atomic.Bool
+	done      chan struct{} // Closed when the stream is deleted
+	deleted   bool
+}
+
+type streamEntry struct {
+	offset    uint64
+	bytes     int64
+	at        time.Time
+	key       string
+	tombstone bool
+	msg       *Message // Nil when the message is in the store of the stream
+}
+
+// CreateStream turns the topic into a stream.
+//
+// A stream keeps the messages published to the topic in a log, in memory or
+// in the Store of the options, and numbers them with increasing offsets,
+// returned by Message.GetOffset. Consumers added with SubscribeStream read
+// the log from the position of their choice. The retention of the options
+// removes the oldest messages when the stream holds too many messages or
+// bytes, and messages older than MaxAge when messages are appended or read.
+//
+// With Compact set, the stream is compacted in the background every
+// CompactInterval, or once CompactThreshold messages were appended, see
+// CompactStream.
+//
+// Subscribers of the topic added with Subscribe keep receiving the new
+// messages only. It returns ErrStreamExists when the topic is already a
+// stream, ErrInvalidTopic for an invalid topic, ErrCompactionUnsupported when
+// compacting a stream whose store is not a Compacter, and the errors of the
+// store when its messages cannot be read.
+func (b *Broker) CreateStream(topic string, opt StreamOptions) error {
+	if err := b.checkTopic(topic, true); err != nil {
+		return err
+	}
+	if opt.Codec == nil {
+		opt.Codec = JSONCodec{}
+	}
+	if opt.Compact && opt.CompactInterval <= 0 && opt.CompactThreshold <= 0 {
+		opt.CompactInterval = DefaultCompactInterval
+	}
+	if _, ok := opt.Store.(Compacter); opt.Compact && opt.Store != nil && !ok {
+		return ErrCompactionUnsupported
+	}
+
+	st := &stream{
+		topic:     topic,
+		opt:       opt,
+		appended:  make(chan struct{}),
+		consumers: map[string]chan struct{}{},
+		done:      make(chan struct{}),
+	}
+	if opt.Store != nil {
+		if err := st.load(); err != nil {
+			return err
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.streams[topic]; ok {
+		return ErrStreamExists
+	}
+	b.streams[topic] = st
+	if opt.Compact && opt.CompactInterval > 0 {
+		go st.compactEvery(opt.CompactInterval)
+	}
+	return nil
+}
+
+// DeleteStream turns the stream back into an ordinary topic, stops its
+// consumers and closes its store. It reports false when the topic is not a
+// stream.
+func (b *Broker) DeleteStream(topic string) bool {
+	b.mutex.Lock()
+	st := b.streams[topic]
+	delete(b.streams, topic)
+	b.mutex.Unlock()
+	if st == nil {
+		return false
+	}
+
+	if err := st.close(); err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// GetStream returns the state of the stream of the given topic.
+func (b *Broker) GetStream(topic string) (StreamInfo, bool) {
+	st := b.stream(topic)
+	if st == nil {
+		return StreamInfo{}, false
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.prune()
+	return StreamInfo{
+		Topic:     topic,
+		First:     st.first(),
+		Next:      st.next,
+		Messages:  len(st.entries),
+		Bytes:     st.bytes,
+		Consumers: len(st.consumers),
+	}, true
+}
+
+// CompactStream removes from the stream of the given topic every message
+// followed by a newer message with the same key, given with WithKey, and
+// returns how many it removed. The newest message of each key is never
+// removed, unless it is a tombstone, published with a nil payload to delete
+// the key, older than TombstoneRetention. Messages without a key are kept.
+// A consumer starting at the earliest offset of a compacted stream rebuilds
+// the latest state of each key.
+//
+// A FileStore keeps the messages of its active segment until the segment is
+// full. It returns ErrStreamNotFound when the topic is not a stream,
+// ErrCompactionUnsupported when its store is not a Compacter, and the errors
+// of the store.
+func (b *Broker) CompactStream(topic string) (int, error) {
+	st := b.stream(topic)
+	if st == nil {
+		return 0, ErrStreamNotFound
+	}
+	return st.compact()
+}
+
+// SubscribeStream adds the subscriber as a consumer of the stream of the
+// given topic, starting at the given position.
+//
+// The consumer receives the messages of the stream in offset order, then
+// every message appended to it, until UnsubscribeStream is called or the
+// subscriber is removed. Subscribing a consumer twice has no effect. A slow
+// consumer is not subject to its overflow policy: the stream waits for free
+// space in its buffer, so no entry is skipped.
+//
+// It returns ErrStreamNotFound when the topic is not a stream, and the same
+// errors as TrySubscribe.
+func (b *Broker) SubscribeStream(s *Subscriber, topic string, start StartPosition) error {
+	if err := b.checkSubscription(s, topic); err != nil {
+		return err
+	}
+	st := b.stream(topic)
+	if st == nil {
+		return ErrStreamNotFound
+	}
+
+	st.mutex.Lock()
+	if st.deleted {
+		st.mutex.Unlock()
+		return ErrStreamNotFound
+	}
+	if _, ok := st.consumers[s.ID]; ok {
+		st.mutex.Unlock()
+		return nil
+	}
+	stop := make(chan struct{})
+	st.consumers[s.ID] = stop
+	st.prune()
+	cursor := st.resolve(start)
+	st.mutex.Unlock()
+
+	go b.consume(st, s, cursor, stop)
+	return nil
+}
+
+// UnsubscribeStream stops the subscriber consuming the stream of the given
+// topic. It returns ErrNotSubscribed when the subscriber is not a consumer of
+// the stream.
+func (b *Broker) UnsubscribeStream(s *Subscriber, topic string) error {
+	st := b.stream(topic)
+	if st == nil {
+		return ErrNotSubscribed
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	stop, ok := st.consumers[s.ID]
+	if !ok {
+		return ErrNotSubscribed
+	}
+	delete(st.consumers, s.ID)
+	close(stop)
+	return nil
+}
+
+// stream returns the stream of the topic, or nil.
+func (b *Broker) stream(topic string) *stream {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.streams[topic]
+}
+
+// closeStreams closes the stores of every stream.
+func (b *Broker) closeStreams() error {
+	b.mutex.Lock()
+	streams := b.streams
+	b.streams = map[string]*stream{}
+	b.mutex.Unlock()
+
+	var errs []error
+	for _, st := range streams {
+		if err := st.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// consume hands the messages of the stream to the subscriber, starting at
+// the cursor.
+func (b *Broker) consume(st *stream, s *Subscriber, cursor uint64, stop chan struct{}) {
+	defer func() {
+		st.mutex.Lock()
+		if st.consumers[s.ID] == stop {
+			delete(st.consumers, s.ID)
+		}
+		st.mutex.Unlock()
+	}()
+
+	for {
+		messages, appended, err := st.read(cursor, streamBatch)
+		if err != nil {
+			log.Printf("pubsub: read stream %s: %v\n", st.topic, err)
+			return
+		}
+		for _, m := range messages {
+			m.broker = b
+			if !b.feed(s, m, stop) {
+				return
+			}
+			cursor = m.streamOffset + 1
+		}
+		if len(messages) > 0 {
+			continue
+		}
+
+		select {
+		case <-appended:
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// feed hands the message of the stream to the consumer. Unlike signal, it
+// waits for free space in the buffer of the consumer instead of applying its
+// overflow policy, so a slow consumer does not skip entries of the stream. It
+// reports false when the consumer stopped first.
+func (b *Broker) feed(s *Subscriber, m *Message, stop <-chan struct{}) bool {
+	if m.IsExpired() {
+		s.expire(m)
+		return true
+	}
+	if b.opt.AtLeastOnce {
+		b.track(s, m)
+	}
+	if s.wait(m, stop) {
+		return true
+	}
+	m.settle()
+	return false
+}
+
+// append adds the message to the stream, numbering it with the next offset,
+// then applies the retention.
+func (st *stream) append(m *Message) error {
+	payload, err := st.opt.Codec.Marshal(m.topic, m.content)
+	if err != nil {
+		return err
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	entry := streamEntry{
+		offset:    st.next,
+		bytes:     int64(len(payload)),
+		at:        m.publishedAt,
+		key:       m.key,
+		tombstone: m.content == nil,
+	}
+	if st.opt.Store != nil {
+		offset, err := st.opt.Store.Append(newRecord(m, payload))
+		if err != nil {
+			return err
+		}
+		entry.offset = offset
+	}
+	m.streamOffset = entry.offset
+	if st.opt.Store == nil {
+		entry.msg = m
+	}
+
+	st.entries = append(st.entries, entry)
+	st.bytes += entry.bytes
+	st.next = entry.offset + 1
+	st.prune()
+
+	close(st.appended)
+	st.appended = make(chan struct{})
+
+	st.appends++
+	if st.opt.Compact && st.opt.CompactThreshold > 0 && st.appends >= st.opt.CompactThreshold && !st.compactor.Load() {
+		go st.autoCompact()
+	}
+	return nil
+}
+
+// load reads the index of the stream from its store.
+func (st *stream) load() error {
+	records, err := st.opt.Store.Read(0, 0)
+	if err != nil {
+		return err
+	}
+	tombstone, err := st.opt.Codec.Marshal(st.topic, nil)
+	if err != nil {
+		return err
+	}
+
+	st.entries = make([]streamEntry, 0, len(records))
+	st.bytes = 0
+	for _, record := range records {
+		st.entries = append(st.entries, streamEntry{
+			offset:    record.Offset,
+			bytes:     int64(len(record.Payload)),
+			at:        record.PublishedAt,
+			key:       record.Key,
+			tombstone: bytes.Equal(record.Payload, tombstone),
+		})
+		st.bytes += int64(len(record.Payload))
+		st.next = max(st.next, record.Offset+1)
+	}
+	return nil
+}
+
+// compact removes the messages superseded by a newer message with the same
+// key, and the expired tombstones.
+func (st *stream) compact() (int, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	compacter, ok := st.opt.Store.(Compacter)
+	if st.opt.Store != nil && !ok {
+		return 0, ErrCompactionUnsupported
+	}
+	if st.deleted {
+		return 0, nil
+	}
+	st.appends = 0
+
+	stale := map[uint64]bool{}
+	seen := map[string]bool{}
+	for i := len(st.entries) - 1; i >= 0; i-- {
+		entry := st.entries[i]
+		if entry.key == "" {
+			continue
+		}
+		if seen[entry.key] || (entry.tombstone && time.Since(entry.at) >= st.opt.TombstoneRetention) {
+			stale[entry.offset] = true
+		}
+		seen[entry.key] = true
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+
+	removed := stale
+	if compacter != nil {
+		removed = map[uint64]bool{}
+		err := compacter.Compact(func(record *Record) bool {
+			if stale[record.Offset] {
+				removed[record.Offset] = true
+			}
+			return stale[record.Offset]
+		})
+		if err != nil {
+			// The store may have rewritten part of its log.
+			return 0, errors.Join(err, st.load())
+		}
+	}
+
+	kept := st.entries[:0]
+	for _, entry := range st.entries {
+		if removed[entry.offset] {
+			st.bytes -= entry.bytes
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	clear(st.entries[len(kept):])
+	n := len(st.entries) - len(kept)
+	st.entries = kept
+	return n, nil
+}
+
+// compactEvery compacts the stream at the given interval until it is
+// deleted.
+func (st *stream) compactEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			st.autoCompact()
+		case <-st.done:
+			return
+		}
+	}
+}
+
+// autoCompact compacts the stream in the background, unless a background
+// compaction is already running.
+func (st *stream) autoCompact() {
+	if !st.compactor.CompareAndSwap(false, true) {
+		return
+	}
+	defer st.compactor.Store(false)
+
+	if _, err := st.compact(); err != nil {
+		log.Printf("pubsub: compact stream %s: %v\n", st.topic, err)
+	}
+}
+
+// read returns up to limit messages starting at the cursor, and a channel
+// closed when the next message is appended.
+func (st *stream) read(cursor uint64, limit int) ([]*Message, <-chan struct{}, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.prune()
+	appended := st.appended
+	i := sort.Search(len(st.entries), func(i int) bool {
+		return st.entries[i].offset >= cursor
+	})
+	if i == len(st.entries) {
+		return nil, appended, nil
+	}
+	entries := st.entries[i:min(len(st.entries), i+limit)]
+
+	messages := make([]*Message, 0, len(entries))
+	if st.opt.Store == nil {
+		for _, entry := range entries {
+			messages = append(messages, entry.msg.clone())
+		}
+		return messages, appended, nil
+	}
+
+	records, err := st.opt.Store.Read(entries[0].offset, len(entries))
+	if err != nil {
+		return nil, appended, err
+	}
+	for _, record := range records {
+		payload, err := st.opt.Codec.Unmarshal(record.Topic, record.Payload)
+		if err != nil {
+			return nil, appended, err
+		}
+		m := &Message{
+			topic:          record.Topic,
+			content:        payload,
+			id:             record.ID,
+			publishedAt:    record.PublishedAt,
+			publisher:      record.Publisher,
+			correlationID:  record.CorrelationID,
+			causationID:    record.CausationID,
+			key:            record.Key,
+			priority:       record.Priority,
+			idempotencyKey: record.IdempotencyKey,
+			headers:        record.Headers,
+			streamOffset:   record.Offset,
+		}
+		m.restoreExpiry(record.TTL)
+		messages = append(messages, m)
+	}
+	return messages, appended, nil
+}
+
+// prune removes the oldest messages beyond the retention of the stream. The
+// caller must hold the mutex.
+func (st *stream) prune() {
+	n := 0
+	for n < len(st.entries) && st.expired(n) {
+		st.bytes -= st.entries[n].bytes
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	if st.opt.Store != nil {
+		if err := st.opt.Store.Truncate(st.entries[n-1].offset + 1); err != nil {
+			log.Println(err)
+		}
+	}
+	clear(st.entries[:n])
+	st.entries = st.entries[n:]
+}
+
+// expired reports whether the i-th oldest message is beyond the retention,
+// once the messages before it are removed. The caller must hold the mutex.
+func (st *stream) expired(i int) bool {
+	remaining := len(st.entries) - i
+	if st.opt.MaxMessages > 0 && remaining > st.opt.MaxMessages {
+		return true
+	}
+	if st.opt.MaxBytes > 0 && st.bytes > st.opt.MaxBytes {
+		return true
+	}
+	return st.opt.MaxAge > 0 && time.Since(st.entries[i].at) > st.opt.MaxAge
+}
+
+// resolve returns the offset of the first message read from the start
+// position. The caller must hold the mutex.
+func (st *stream) resolve(start StartPosition) uint64 {
+	switch start.kind {
+	case startEarliest:
+		return st.first()
+	case startOffset:
+		return max(start.offset, st.first())
+	case startTime:
+		i := sort.Search(len(st.entries), func(i int) bool {
+			return !st.entries[i].at.Before(start.time)
+		})
+		if i < len(st.entries) {
+			return st.entries[i].offset
+		}
+	}
+	return st.next
+}
+
+// first returns the offset of the oldest message kept. The caller must hold
+// the mutex.
+func (st *stream) first() uint64 {
+	if len(st.entries) == 0 {
+		return st.next
+	}
+	return st.entries[0].offset
+}
+
+// close stops the consumers of the stream and closes its store.
+func (st *stream) close() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.deleted {
+		return nil
+	}
+	st.deleted = true
+	close(st.done)
+	for id, stop := range st.consumers {
+		close(stop)
+		delete(st.consumers, id)
+	}
+	if st.opt.Store != nil {
+		return st.opt.Store.Close()
+	}
+	return nil
+}
+
+// GetOffset returns the offset of the message in the stream of its topic. It
+// is 0 when the topic is not a stream.
+func (m *Message) GetOffset() uint64 {
+	return m.streamOffset
+}
@@ -0,0 +1,294 @@
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_Stream(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("events", pubsub.StreamOptions{}))
+	require.ErrorIs(t, broker.CreateStream("events", pubsub.StreamOptions{}), pubsub.ErrStreamExists)
+
+	live := broker.AddSubscriber()
+	broker.Subscribe(live, "events")
+	for i := 0; i < 5; i++ {
+		broker.Publish("events", i)
+	}
+	for i := 0; i < 5; i++ {
+		msg := <-live.GetMessages()
+		require.Equal(t, i, msg.GetContent())
+		require.Equal(t, uint64(i), msg.GetOffset())
+	}
+
+	info, ok := broker.GetStream("events")
+	require.True(t, ok)
+	require.Equal(t, uint64(0), info.First)
+	require.Equal(t, uint64(5), info.Next)
+	require.Equal(t, 5, info.Messages)
+
+	earliest := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(earliest, "events", pubsub.StartEarliest()))
+	fromOffset := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(fromOffset, "events", pubsub.StartAtOffset(3)))
+	latest := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(latest, "events", pubsub.StartLatest()))
+	require.Nil(t, broker.SubscribeStream(latest, "events", pubsub.StartEarliest()))
+
+	require.Equal(t, []any{0, 1, 2, 3, 4}, drain(earliest))
+	require.Equal(t, []any{3, 4}, drain(fromOffset))
+	require.Empty(t, drain(latest))
+
+	broker.Publish("events", 5)
+	require.Equal(t, []any{5}, drain(earliest))
+	require.Equal(t, []any{5}, drain(latest))
+
+	require.Nil(t, broker.UnsubscribeStream(latest, "events"))
+	require.ErrorIs(t, broker.UnsubscribeStream(latest, "events"), pubsub.ErrNotSubscribed)
+	broker.Publish("events", 6)
+	require.Empty(t, drain(latest))
+	require.Equal(t, []any{6}, drain(earliest))
+
+	require.ErrorIs(t, broker.SubscribeStream(latest, "orders", pubsub.StartEarliest()), pubsub.ErrStreamNotFound)
+	require.True(t, broker.DeleteStream("events"))
+	require.False(t, broker.DeleteStream("events"))
+	broker.Publish("events", 7)
+	require.Empty(t, drain(earliest))
+}
+
+func Test_StreamSlowConsumer(t *testing.T) {
+	for _, delivery := range []pubsub.DeliveryMode{pubsub.DeliveryOrdered, pubsub.DeliveryConcurrent} {
+		broker := pubsub.NewBroker(pubsub.BrokerOptions{Delivery: delivery})
+		require.Nil(t, broker.CreateStream("events", pubsub.StreamOptions{}))
+		for i := range 300 {
+			broker.Publish("events", i)
+		}
+
+		// The replay waits for the consumer instead of dropping the entries
+		// that do not fit in its buffer.
+		sub := broker.AddSubscriber(pubsub.SubscriberOptions{
+			BufferSize: 4,
+			Overflow:   pubsub.OverflowDropNewest,
+		})
+		require.Nil(t, broker.SubscribeStream(sub, "events", pubsub.StartEarliest()))
+		for i := range 300 {
+			if i%50 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			select {
+			case msg := <-sub.GetMessages():
+				require.Equal(t, i, msg.GetContent())
+			case <-time.After(time.Second):
+				t.Fatalf("received %d of 300 entries", i)
+			}
+		}
+		require.Zero(t, sub.Dropped())
+		broker.RemoveSubscriber(sub)
+	}
+}
+
+func Test_StreamStartAtTime(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("events", pubsub.StreamOptions{}))
+
+	broker.Publish("events", "before")
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now()
+	broker.Publish("events", "after")
+
+	sub := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(sub, "events", pubsub.StartAtTime(since)))
+	require.Equal(t, []any{"after"}, drain(sub))
+
+	future := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(future, "events", pubsub.StartAtTime(time.Now().Add(time.Hour))))
+	require.Empty(t, drain(future))
+}
+
+func Test_StreamRetention(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("count", pubsub.StreamOptions{MaxMessages: 3}))
+	require.Nil(t, broker.CreateStream("bytes", pubsub.StreamOptions{MaxBytes: 10}))
+	require.Nil(t, broker.CreateStream("age", pubsub.StreamOptions{MaxAge: 20 * time.Millisecond}))
+
+	for i := 0; i < 10; i++ {
+		broker.Publish("count", i)
+		broker.Publish("bytes", "abc") // 5 bytes in JSON
+	}
+	broker.Publish("age", "old")
+
+	info, _ := broker.GetStream("count")
+	require.Equal(t, uint64(7), info.First)
+	require.Equal(t, 3, info.Messages)
+	sub := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(sub, "count", pubsub.StartAtOffset(2)))
+	require.Equal(t, []any{7, 8, 9}, drain(sub))
+
+	info, _ = broker.GetStream("bytes")
+	require.Equal(t, 2, info.Messages)
+	require.Equal(t, int64(10), info.Bytes)
+
+	time.Sleep(30 * time.Millisecond)
+	info, _ = broker.GetStream("age")
+	require.Equal(t, 0, info.Messages)
+	require.Equal(t, uint64(1), info.First)
+}
+
+func Test_StreamStore(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("events", pubsub.StreamOptions{
+		Store:       openStore(t, dir),
+		MaxMessages: 3,
+	}))
+	for i := 0; i < 5; i++ {
+		broker.Publish("events", i)
+	}
+	_, err := broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	// The stream is read back from disk, JSON numbers decoded as float64.
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("events", pubsub.StreamOptions{
+		Store:       openStore(t, dir),
+		MaxMessages: 3,
+	}))
+	info, _ := broker.GetStream("events")
+	require.Equal(t, uint64(2), info.First)
+	require.Equal(t, uint64(5), info.Next)
+
+	sub := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(sub, "events", pubsub.StartEarliest()))
+
+	var offsets []uint64
+	var contents []any
+	for i := 0; i < 4; i++ {
+		if i == 3 {
+			broker.Publish("events", 5)
+		}
+		msg := <-sub.GetMessages()
+		offsets = append(offsets, msg.GetOffset())
+		contents = append(contents, msg.GetContent())
+	}
+	require.Equal(t, []uint64{2, 3, 4, 5}, offsets)
+	require.Equal(t, []any{float64(2), float64(3), float64(4), float64(5)}, contents)
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+}
+
+func Test_StreamCompact(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("accounts", pubsub.StreamOptions{TombstoneRetention: time.Hour}))
+
+	broker.PublishWithOptions("accounts", 10, pubsub.WithKey("alice"))
+	broker.PublishWithOptions("accounts", 20, pubsub.WithKey("bob"))
+	broker.PublishWithOptions("accounts", 11, pubsub.WithKey("alice"))
+	broker.Publish("accounts", "unkeyed")
+	broker.PublishWithOptions("accounts", nil, pubsub.WithKey("bob"))
+	broker.PublishWithOptions("accounts", 12, pubsub.WithKey("alice"))
+
+	removed, err := broker.CompactStream("accounts")
+	require.Nil(t, err)
+	require.Equal(t, 3, removed)
+
+	// The tombstone of bob is kept until its retention expires.
+	sub := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(sub, "accounts", pubsub.StartEarliest()))
+	var keys []string
+	var offsets []uint64
+	for i := 0; i < 3; i++ {
+		msg := <-sub.GetMessages()
+		keys = append(keys, msg.GetKey())
+		offsets = append(offsets, msg.GetOffset())
+	}
+	require.Equal(t, []string{"", "bob", "alice"}, keys)
+	require.Equal(t, []uint64{3, 4, 5}, offsets)
+
+	removed, err = broker.CompactStream("accounts")
+	require.Nil(t, err)
+	require.Equal(t, 0, removed)
+	_, err = broker.CompactStream("orders")
+	require.ErrorIs(t, err, pubsub.ErrStreamNotFound)
+}
+
+func Test_StreamCompactThreshold(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("config", pubsub.StreamOptions{
+		Compact:          true,
+		CompactThreshold: 10,
+	}))
+	for i := 0; i < 10; i++ {
+		broker.PublishWithOptions("config", i, pubsub.WithKey("timeout"))
+	}
+	broker.PublishWithOptions("config", "on", pubsub.WithKey("feature"))
+	broker.PublishWithOptions("config", nil, pubsub.WithKey("feature"))
+
+	require.Eventually(t, func() bool {
+		info, _ := broker.GetStream("config")
+		return info.Messages <= 3
+	}, time.Second, 5*time.Millisecond)
+
+	// Compacting again removes the tombstone, never the latest timeout.
+	_, err := broker.CompactStream("config")
+	require.Nil(t, err)
+	sub := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(sub, "config", pubsub.StartEarliest()))
+	require.Equal(t, []any{9}, drain(sub))
+
+	require.ErrorIs(t, broker.CreateStream("memory", pubsub.StreamOptions{
+		Compact: true,
+		Store:   pubsub.NewMemoryStore(),
+	}), pubsub.ErrCompactionUnsupported)
+}
+
+func Test_StreamCompactStore(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *pubsub.FileStore {
+		store, err := pubsub.OpenFileStore(dir, pubsub.FileStoreOptions{SegmentSize: 300})
+		require.Nil(t, err)
+		return store
+	}
+
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("accounts", pubsub.StreamOptions{Store: open(), Compact: true}))
+	for i := 0; i < 20; i++ {
+		broker.PublishWithOptions("accounts", i, pubsub.WithKey([]string{"alice", "bob"}[i%2]))
+	}
+	broker.PublishWithOptions("accounts", nil, pubsub.WithKey("bob"))
+	broker.PublishWithOptions("accounts", "last", pubsub.WithKey("carol"))
+
+	removed, err := broker.CompactStream("accounts")
+	require.Nil(t, err)
+	require.Greater(t, removed, 0)
+	info, _ := broker.GetStream("accounts")
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+
+	// The compacted stream is read back from disk, and still ends with the
+	// latest message of each key.
+	broker = pubsub.NewBroker(pubsub.BrokerOptions{})
+	require.Nil(t, broker.CreateStream("accounts", pubsub.StreamOptions{Store: open(), Compact: true}))
+	reopened, _ := broker.GetStream("accounts")
+	require.Equal(t, info.Messages, reopened.Messages)
+	require.Equal(t, uint64(22), reopened.Next)
+
+	sub := broker.AddSubscriber()
+	require.Nil(t, broker.SubscribeStream(sub, "accounts", pubsub.StartEarliest()))
+	state := map[string]any{}
+	for i := 0; i < reopened.Messages; i++ {
+		msg := <-sub.GetMessages()
+		if msg.GetContent() == nil {
+			delete(state, msg.GetKey())
+		} else {
+			state[msg.GetKey()] = msg.GetContent()
+		}
+	}
+	require.Equal(t, map[string]any{"alice": float64(18), "carol": "last"}, state)
+	_, err = broker.Shutdown(context.Background())
+	require.Nil(t, err)
+}
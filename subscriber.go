@@ -5,34 +5,214 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultBufferSize is the number of messages a subscriber can hold before
+// its overflow policy applies, when no buffer size is configured.
+const DefaultBufferSize = 128
+
+// DefaultBlockTimeout is how long OverflowBlock waits for free space in the
+// buffer of a subscriber, when no timeout is configured. Subscribers of a
+// broker with AtLeastOnce, and of Handler, wait until they are removed
+// instead.
+const DefaultBlockTimeout = 100 * time.Millisecond
+
+// OverflowPolicy decides what happens to a message that arrives while the
+// subscriber's buffer is full.
+//
+// The zero value inherits the policy of the broker, which itself falls back
+// to OverflowBlock.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for free space in the buffer. The wait is bounded
+	// by BlockTimeout; the message is dropped when the timeout expires.
+	// Subscribers that must not lose messages wait without a bound by
+	// default, see DefaultBlockTimeout.
+	OverflowBlock OverflowPolicy = iota + 1
+	// OverflowDropNewest drops the incoming message.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest buffered message to make room for
+	// the incoming one.
+	OverflowDropOldest
+	// OverflowDisconnect drops the incoming message and removes the slow
+	// subscriber from the broker.
+	OverflowDisconnect
+)
+
+// DropHandler is called for every message that a subscriber drops because its
+// buffer is full. The policy is the one that caused the drop.
+type DropHandler func(s *Subscriber, msg *Message, policy OverflowPolicy)
+
+type SubscriberOptions struct {
+	// the number of messages buffered for the subscriber
+	BufferSize int
+	// what to do when the buffer is full
+	Overflow OverflowPolicy
+	// how long OverflowBlock waits for free space, defaults to
+	// DefaultBlockTimeout, a negative timeout waits until the subscriber is
+	// removed
+	BlockTimeout time.Duration
+	// called for every dropped message
+	OnDrop DropHandler
+	// set this to `true` to dispatch messages in the order they are signalled
+	Ordered bool
+	// set this to `true` to dispatch queued messages by decreasing priority,
+	// implies Ordered
+	Priority bool
+	// where messages that keep failing are sent, overrides the dead-letter
+	// policy of the broker
+	DeadLetter *DeadLetterPolicy
+}
+
 type Subscriber struct {
-	ID       string          // ID of subscriber
-	messages chan *Message   // Message channel
-	topics   map[string]bool // Topics it is subscribed to
-	active   bool            // It given subscriber is active
+	ID       string            // ID of subscriber
+	messages chan *Message     // Message channel
+	topics   map[string]bool   // Topics it is subscribed to
+	groups   map[string]string // Consumer group joined per topic
+	active   bool              // It given subscriber is active
 	mutex    sync.RWMutex
+	opt      SubscriberOptions
+	done     chan struct{} // Closed when the subscriber is destructed
+	once     sync.Once
+	dropped  atomic.Uint64
+	expired  atomic.Uint64
+	// sending is held while sending to the message channel, Destruct takes it
+	// to close the channel. It is separate from mutex so a Signal waiting for
+	// buffer space does not block the topics of the subscriber.
+	sending sync.RWMutex
+	// queue holds pending messages of an ordered subscriber, it is nil for
+	// subscribers that are signalled concurrently.
+	queue       *queue
+	dispatching sync.WaitGroup
+	// onDisconnect is set by the broker to remove the subscriber when the
+	// OverflowDisconnect policy applies.
+	onDisconnect func(s *Subscriber)
+	// durable is the durable subscription of the subscriber, if any.
+	durable *durable
 }
 
 // NewSubscriber creates and returns a new Subscriber with a unique ID.
 //
 // It generates a random ID for the subscriber and initializes the subscriber
-// with an empty message channel and an empty topic map. The subscriber is
+// with a buffered message channel and an empty topic map. The subscriber is
 // marked as active. If there's an error during ID generation, the program
-// will log a fatal error and terminate.
-func NewSubscriber() (string, *Subscriber) {
-	b := make([]byte, 8)
-	_, err := rand.Read(b)
+// will log a fatal error and terminate; use TryNewSubscriber to handle it.
+//
+// The first options, if given, configure the buffer size and overflow policy
+// of the subscriber. Unset fields fall back to DefaultBufferSize and
+// OverflowBlock.
+func NewSubscriber(opts ...SubscriberOptions) (string, *Subscriber) {
+	s, err := TryNewSubscriber(opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	id := fmt.Sprintf("%X0%X", b[0:4], b[4:8])
-	return id, &Subscriber{
-		ID:       id,
-		messages: make(chan *Message),
-		topics:   map[string]bool{},
-		active:   true,
+	return s.ID, s
+}
+
+// TryNewSubscriber creates and returns a new Subscriber with a unique ID, or
+// the error that prevented generating the ID.
+//
+// An ordered subscriber buffers messages in a queue and starts a single
+// dispatch loop that hands them to the message channel one by one, so
+// messages are received in the order they were signalled. A priority
+// subscriber hands the queued messages of the highest priority first.
+func TryNewSubscriber(opts ...SubscriberOptions) (*Subscriber, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	var opt SubscriberOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.BufferSize <= 0 {
+		opt.BufferSize = DefaultBufferSize
+	}
+	if opt.Overflow == 0 {
+		opt.Overflow = OverflowBlock
+	}
+	if opt.BlockTimeout == 0 {
+		opt.BlockTimeout = DefaultBlockTimeout
+	}
+	if opt.Priority {
+		opt.Ordered = true
+	}
+
+	s := &Subscriber{
+		ID:     id,
+		topics: map[string]bool{},
+		groups: map[string]string{},
+		active: true,
+		opt:    opt,
+		done:   make(chan struct{}),
+	}
+	if opt.Ordered {
+		s.messages = make(chan *Message)
+		s.queue = newQueue(opt.BufferSize, opt.Priority)
+		s.dispatching.Add(1)
+		go s.dispatch()
+	} else {
+		s.messages = make(chan *Message, opt.BufferSize)
+	}
+
+	return s, nil
+}
+
+// newID returns a random hexadecimal ID.
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("pubsub: generate id: %w", err)
+	}
+	return fmt.Sprintf("%X0%X", b[0:4], b[4:8]), nil
+}
+
+// dispatch hands the queued messages to the message channel in order until
+// the subscriber is destructed.
+func (s *Subscriber) dispatch() {
+	defer s.dispatching.Done()
+
+	for {
+		msg, ok := s.queue.pop(s.done)
+		if !ok {
+			return
+		}
+		if msg.IsExpired() {
+			s.expire(msg)
+			s.queue.sent()
+			continue
+		}
+
+		// A message with a TTL is dropped when it expires before the
+		// subscriber receives it.
+		var timer *time.Timer
+		var expiry <-chan time.Time
+		if !msg.expiresAt.IsZero() {
+			timer = time.NewTimer(time.Until(msg.expiresAt))
+			expiry = timer.C
+		}
+		done := false
+		select {
+		case s.messages <- msg:
+			msg.handed()
+			s.queue.sent()
+		case <-expiry:
+			s.expire(msg)
+			s.queue.sent()
+		case <-s.done:
+			msg.discard()
+			done = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return
+		}
 	}
 }
 
@@ -44,8 +224,8 @@ func NewSubscriber() (string, *Subscriber) {
 //
 // The subscriber is not added if it is already subscribed to the topic.
 func (s *Subscriber) AddTopic(topic string) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.topics[topic] = true
 }
 
@@ -56,9 +236,36 @@ func (s *Subscriber) AddTopic(topic string) {
 // specified topic. If the topic does not exist in the subscriber's list, the
 // function performs no action.
 func (s *Subscriber) RemoveTopic(topic string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.topics, topic)
+	delete(s.groups, topic)
+}
+
+// joinGroup records that the subscriber receives the topic as a member of the
+// given consumer group.
+func (s *Subscriber) joinGroup(topic string, group string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.topics[topic] = true
+	s.groups[topic] = group
+}
+
+// GetGroup returns the consumer group through which the subscriber receives
+// the given topic, or an empty string when it receives every message.
+func (s *Subscriber) GetGroup(topic string) string {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	delete(s.topics, topic)
+
+	return s.groups[topic]
+}
+
+// isSubscribed reports whether the subscriber is subscribed to the topic.
+func (s *Subscriber) isSubscribed(topic string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.topics[topic]
 }
 
 // GetTopic returns the list of topics to which the subscriber is subscribed.
@@ -76,29 +283,257 @@ func (s *Subscriber) GetTopic() []string {
 // Destruct marks the subscriber as inactive and closes the message channel.
 //
 // The subscriber will no longer receive messages and resources associated with
-// the subscriber are released.
+// the subscriber are released. Calling Destruct more than once has no effect.
 func (s *Subscriber) Destruct() {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	// Wake up any Signal waiting for buffer space and stop the dispatch loop
+	// before taking the lock.
+	s.once.Do(func() { close(s.done) })
+	s.dispatching.Wait()
+	if s.queue != nil {
+		for _, msg := range s.queue.clear() {
+			msg.discard()
+		}
+	}
 
+	s.mutex.Lock()
+	if !s.active {
+		s.mutex.Unlock()
+		return
+	}
 	s.active = false
+	s.mutex.Unlock()
+
+	s.sending.Lock()
+	defer s.sending.Unlock()
 	close(s.messages)
 }
 
+// closing reports whether the subscriber is being destructed.
+func (s *Subscriber) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsActive reports whether the subscriber can still receive messages.
+func (s *Subscriber) IsActive() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.active
+}
+
 // Signal sends the given message to the subscriber.
 //
 // The message is sent to the subscriber only if the subscriber is active.
 // If the subscriber is inactive, the message is not sent.
+//
+// When the buffer of the subscriber is full, the overflow policy of the
+// subscriber decides whether Signal waits for free space, drops the new
+// message, drops the oldest buffered message or disconnects the subscriber.
+//
+// An expired message is dropped rather than sent, see WithTTL.
 func (s *Subscriber) Signal(msg *Message) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	if msg.IsExpired() {
+		s.expire(msg)
+		return
+	}
+	if s.queue != nil {
+		s.enqueue(msg)
+		return
+	}
+
+	s.sending.RLock()
+	if !s.IsActive() {
+		s.sending.RUnlock()
+		msg.discard()
+		return
+	}
+
+	select {
+	case s.messages <- msg:
+		s.sending.RUnlock()
+		msg.handed()
+		return
+	default:
+	}
 
-	if s.active {
-		s.messages <- msg
-		// fmt.Printf("%v Receiver message %s from topic: %s\n", time.Now().Format("2006-01-01 08:00:00"), msg.GetContent(), msg.GetTopic())
+	dropped := msg
+	switch s.opt.Overflow {
+	case OverflowDropOldest:
+		select {
+		case dropped = <-s.messages:
+		default:
+			dropped = nil
+		}
+		select {
+		case s.messages <- msg:
+			msg.handed()
+		default:
+			// Another publisher took the free slot.
+			s.drop(dropped)
+			dropped = msg
+		}
+	case OverflowBlock:
+		var timeout <-chan time.Time
+		if s.opt.BlockTimeout > 0 {
+			timer := time.NewTimer(s.opt.BlockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case s.messages <- msg:
+			msg.handed()
+			dropped = nil
+		case <-timeout:
+		case <-s.done:
+		}
+	}
+	s.sending.RUnlock()
+
+	s.drop(dropped)
+	if dropped != nil && s.opt.Overflow == OverflowDisconnect && s.onDisconnect != nil {
+		s.onDisconnect(s)
+	}
+}
+
+// signalAsync sends the given message to the subscriber like Signal, without
+// blocking the caller. Only a message waiting for free space in the buffer
+// of an OverflowBlock subscriber is sent by a goroutine of its own, which
+// gives up after the BlockTimeout of the subscriber.
+func (s *Subscriber) signalAsync(msg *Message) {
+	if s.opt.Overflow != OverflowBlock || msg.IsExpired() {
+		s.Signal(msg)
+		return
+	}
+	if !s.offer(msg) {
+		go s.Signal(msg)
 	}
 }
 
+// offer sends the given message to the subscriber if it has free space in
+// its buffer. It reports false when the message could not be sent yet.
+func (s *Subscriber) offer(msg *Message) bool {
+	if s.queue != nil {
+		return s.IsActive() && s.queue.push(msg)
+	}
+
+	s.sending.RLock()
+	defer s.sending.RUnlock()
+
+	if !s.IsActive() {
+		return false
+	}
+	select {
+	case s.messages <- msg:
+		msg.handed()
+		return true
+	default:
+		return false
+	}
+}
+
+// wait sends the given message to the subscriber, waiting for free space in
+// its buffer whatever its overflow policy. It reports false when the
+// subscriber is removed or stop is closed before the message could be sent.
+func (s *Subscriber) wait(msg *Message, stop <-chan struct{}) bool {
+	if s.queue != nil {
+		for s.IsActive() && !s.closing() {
+			if s.queue.push(msg) {
+				return true
+			}
+			select {
+			case <-s.queue.space:
+			case <-stop:
+				return false
+			case <-s.done:
+				return false
+			}
+		}
+		return false
+	}
+
+	s.sending.RLock()
+	defer s.sending.RUnlock()
+
+	if !s.IsActive() {
+		return false
+	}
+	select {
+	case s.messages <- msg:
+		msg.handed()
+		return true
+	case <-stop:
+		return false
+	case <-s.done:
+		return false
+	}
+}
+
+// enqueue adds the given message to the queue of an ordered subscriber,
+// applying the overflow policy when the queue is full.
+func (s *Subscriber) enqueue(msg *Message) {
+	if !s.IsActive() {
+		msg.discard()
+		return
+	}
+
+	dropped := msg
+	switch s.opt.Overflow {
+	case OverflowDropOldest:
+		dropped = s.queue.pushEvict(msg)
+	case OverflowBlock:
+		if s.queue.pushWait(msg, s.opt.BlockTimeout, s.done) {
+			dropped = nil
+		}
+	default:
+		if s.queue.push(msg) {
+			dropped = nil
+		}
+	}
+	if dropped == nil {
+		return
+	}
+	if !s.IsActive() {
+		dropped.discard()
+		return
+	}
+
+	s.drop(dropped)
+	if s.opt.Overflow == OverflowDisconnect && s.onDisconnect != nil {
+		s.onDisconnect(s)
+	}
+}
+
+// Pending returns the number of messages signalled to the subscriber that
+// have not been received yet.
+func (s *Subscriber) Pending() int {
+	if s.queue != nil {
+		return s.queue.len()
+	}
+	return len(s.messages)
+}
+
+// drop counts the given message as dropped and reports it to the drop handler.
+func (s *Subscriber) drop(msg *Message) {
+	if msg == nil {
+		return
+	}
+	s.dropped.Add(1)
+	if s.opt.OnDrop != nil {
+		s.opt.OnDrop(s, msg, s.opt.Overflow)
+	}
+}
+
+// Dropped returns the number of messages the subscriber has dropped because
+// its buffer was full.
+func (s *Subscriber) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
 // GetMessages returns the message channel of the subscriber.
 //
 // The channel can be used to receive messages sent to the subscriber.
@@ -108,12 +543,11 @@ func (s *Subscriber) GetMessages() chan *Message {
 
 // Listen is a goroutine that listens to the subscriber's message channel.
 //
-// The goroutine will run indefinitely and will receive messages from the
-// subscriber's message channel. Each message is printed to the standard output.
+// The goroutine runs until the subscriber is destructed and receives messages
+// from the subscriber's message channel. Each message is printed to the
+// standard output.
 func (s *Subscriber) Listen() {
-	for {
-		if msg, ok := <-s.messages; ok {
-			fmt.Printf("Subscriber %s, received: %s from topic: %s\n", s.ID, msg.GetContent(), msg.GetTopic())
-		}
+	for msg := range s.messages {
+		fmt.Printf("Subscriber %s, received: %s from topic: %s\n", s.ID, msg.GetContent(), msg.GetTopic())
 	}
 }
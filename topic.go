@@ -0,0 +1,172 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// TypedMessage is a message whose content has been checked to be of type T.
+// The embedded message gives access to the topic, acknowledgement and the
+// other methods of Message.
+type TypedMessage[T any] struct {
+	*Message
+	Payload T
+}
+
+// TypedHandleFnc handles a message of a topic carrying payloads of type T.
+type TypedHandleFnc[T any] func(msg TypedMessage[T]) error
+
+type TopicOptions struct {
+	// called for every received message whose content is not of the type of
+	// the topic, defaults to logging the error
+	OnMismatch func(msg *Message, err error)
+}
+
+// Topic is a handle to publish and subscribe to a topic whose messages carry
+// payloads of type T, so publishers and subscribers agree on the payload type
+// at compile time.
+type Topic[T any] struct {
+	broker      *Broker
+	name        string
+	opt         TopicOptions
+	mutex       sync.Mutex
+	subscribers map[<-chan TypedMessage[T]]*Subscriber
+}
+
+// NewTopic returns a handle to the topic with the given name on the broker.
+//
+// Messages published to the topic without the handle, with Broker.Publish for
+// instance, may carry another type. Such messages are rejected when received
+// and reported to OnMismatch instead of being handed to subscribers.
+func NewTopic[T any](broker *Broker, name string, opts ...TopicOptions) *Topic[T] {
+	t := &Topic[T]{
+		broker:      broker,
+		name:        name,
+		subscribers: map[<-chan TypedMessage[T]]*Subscriber{},
+	}
+	if len(opts) > 0 {
+		t.opt = opts[0]
+	}
+	return t
+}
+
+// Name returns the name of the topic.
+func (t *Topic[T]) Name() string {
+	return t.name
+}
+
+// Publish sends the payload to all subscribers of the topic, with the
+// metadata set by the options. It returns the error of the context when it is
+// already done, or the errors of TryPublish.
+func (t *Topic[T]) Publish(ctx context.Context, payload T, opts ...PublishOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := t.broker.PublishWithOptions(t.name, payload, opts...)
+	return err
+}
+
+// Subscribe returns a channel receiving the messages of the topic. The channel
+// is closed when it is unsubscribed or when the broker shuts down, and is nil
+// when the subscription fails; use TrySubscribe to know why.
+func (t *Topic[T]) Subscribe() <-chan TypedMessage[T] {
+	messages, _ := t.TrySubscribe()
+	return messages
+}
+
+// TrySubscribe returns a channel receiving the messages of the topic, or the
+// errors of TryAddSubscriber and TrySubscribe.
+func (t *Topic[T]) TrySubscribe() (<-chan TypedMessage[T], error) {
+	sub, err := t.broker.TryAddSubscriber()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.broker.TrySubscribe(sub, t.name); err != nil {
+		t.broker.RemoveSubscriber(sub)
+		return nil, err
+	}
+
+	messages := make(chan TypedMessage[T])
+	t.mutex.Lock()
+	t.subscribers[messages] = sub
+	t.mutex.Unlock()
+
+	go (func() {
+		defer close(messages)
+		for msg := range sub.GetMessages() {
+			payload, err := Decode[T](msg)
+			if err != nil {
+				t.mismatch(msg, err)
+				continue
+			}
+			select {
+			case messages <- TypedMessage[T]{Message: msg, Payload: payload}:
+			case <-sub.done:
+				return
+			}
+		}
+	})()
+	return messages, nil
+}
+
+// Unsubscribe removes the subscriber behind the given subscription channel
+// and closes the channel.
+func (t *Topic[T]) Unsubscribe(messages <-chan TypedMessage[T]) {
+	t.mutex.Lock()
+	sub := t.subscribers[messages]
+	delete(t.subscribers, messages)
+	t.mutex.Unlock()
+
+	if sub != nil {
+		t.broker.RemoveSubscriber(sub)
+	}
+}
+
+// mismatch rejects a message carrying another type and reports it.
+func (t *Topic[T]) mismatch(msg *Message, err error) {
+	msg.fail(false, 0, err.Error())
+	if t.opt.OnMismatch != nil {
+		t.opt.OnMismatch(msg, err)
+	} else {
+		log.Printf("pubsub: %v\n", err)
+	}
+}
+
+// Decode returns the content of the message as a value of type T, or an error
+// wrapping ErrTypeMismatch when the content has another type. A nil content
+// decodes to the zero value when T is a pointer, interface, map, slice, channel
+// or function type.
+func Decode[T any](msg *Message) (T, error) {
+	content := msg.GetContent()
+	if payload, ok := content.(T); ok {
+		return payload, nil
+	}
+
+	var zero T
+	if content == nil {
+		switch reflect.TypeFor[T]().Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func:
+			return zero, nil
+		}
+	}
+	return zero, fmt.Errorf("%w: topic %q expects %s, got %T", ErrTypeMismatch, msg.GetTopic(), reflect.TypeFor[T](), content)
+}
+
+// ListenTyped subscribes the handler to the topics of the options and calls
+// factory with the payload of every message received, checked to be of type
+// T. A message of another type is rejected without calling factory or being
+// retried, and reported to OnError.
+//
+// It returns the same errors as TryListenWithOptions.
+func ListenTyped[T any](h *Handler, factory TypedHandleFnc[T], opt ListenOptions) error {
+	return h.TryListenWithOptions(func(msg *Message) error {
+		payload, err := Decode[T](msg)
+		if err != nil {
+			return err
+		}
+		return factory(TypedMessage[T]{Message: msg, Payload: payload})
+	}, opt)
+}
@@ -0,0 +1,90 @@
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+	"github.com/tinh-tinh/tinhtinh/v2/core"
+)
+
+type Price struct {
+	Symbol string
+	Value  float64
+}
+
+func Test_Topic(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+
+	mismatches := make(chan error, 1)
+	prices := pubsub.NewTopic[Price](broker, "prices", pubsub.TopicOptions{
+		OnMismatch: func(msg *pubsub.Message, err error) {
+			mismatches <- err
+		},
+	})
+	require.Equal(t, "prices", prices.Name())
+
+	messages := prices.Subscribe()
+	require.Nil(t, prices.Publish(context.Background(), Price{Symbol: "BTC", Value: 1}))
+	msg := <-messages
+	require.Equal(t, Price{Symbol: "BTC", Value: 1}, msg.Payload)
+	require.Equal(t, "prices", msg.GetTopic())
+
+	broker.Publish("prices", "not a price")
+	require.ErrorIs(t, <-mismatches, pubsub.ErrTypeMismatch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, prices.Publish(ctx, Price{}), context.Canceled)
+
+	prices.Unsubscribe(messages)
+	_, ok := <-messages
+	require.False(t, ok)
+	require.Equal(t, 0, broker.GetSubscribers("prices"))
+}
+
+func Test_Decode(t *testing.T) {
+	value, err := pubsub.Decode[int](pubsub.NewMessage("topic", 1))
+	require.Nil(t, err)
+	require.Equal(t, 1, value)
+
+	pointer, err := pubsub.Decode[*Price](pubsub.NewMessage("topic", nil))
+	require.Nil(t, err)
+	require.Nil(t, pointer)
+
+	_, err = pubsub.Decode[Price](pubsub.NewMessage("topic", nil))
+	require.ErrorIs(t, err, pubsub.ErrTypeMismatch)
+	_, err = pubsub.Decode[string](pubsub.NewMessage("topic", 1))
+	require.ErrorContains(t, err, `topic "topic" expects string, got int`)
+}
+
+func Test_ListenTyped(t *testing.T) {
+	module := core.NewModule(core.NewModuleOptions{
+		Imports: []core.Modules{pubsub.ForRoot(pubsub.BrokerOptions{})},
+	})
+	broker := pubsub.InjectBroker(module)
+
+	calls := 0
+	received := make(chan Price, 1)
+	failed := make(chan error, 1)
+	handler := pubsub.NewHandler(module)
+	err := pubsub.ListenTyped(handler, func(msg pubsub.TypedMessage[Price]) error {
+		calls++
+		received <- msg.Payload
+		return nil
+	}, pubsub.ListenOptions{
+		Topics:  []string{"prices"},
+		Retries: 3,
+		OnError: func(msg *pubsub.Message, err error) {
+			failed <- err
+		},
+	})
+	require.Nil(t, err)
+
+	broker.Publish("prices", 42)
+	require.ErrorIs(t, <-failed, pubsub.ErrTypeMismatch)
+	broker.Publish("prices", Price{Symbol: "ETH", Value: 2})
+	require.Equal(t, "ETH", (<-received).Symbol)
+	require.Equal(t, 1, calls)
+}
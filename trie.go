@@ -0,0 +1,112 @@
+package pubsub
+
+import "strings"
+
+const (
+	// SingleWildcard matches exactly one segment of a topic, in any position.
+	SingleWildcard = "*"
+	// MultiWildcard matches zero or more segments of a topic.
+	MultiWildcard = "#"
+	// GlobWildcard is an alias of MultiWildcard.
+	GlobWildcard = "**"
+)
+
+// topicTrie indexes subscribed topics by their delimiter separated segments,
+// so the topics matching a published topic are found by walking the trie
+// instead of generating every candidate pattern.
+type topicTrie struct {
+	root      *trieNode
+	delimiter string
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	topic    string // Subscribed topic ending at this node
+	terminal bool
+}
+
+func newTopicTrie(delimiter string) *topicTrie {
+	return &topicTrie{
+		root:      &trieNode{children: map[string]*trieNode{}},
+		delimiter: delimiter,
+	}
+}
+
+// insert adds the subscribed topic to the trie.
+func (t *topicTrie) insert(topic string) {
+	node := t.root
+	for _, segment := range strings.Split(topic, t.delimiter) {
+		child := node.children[segment]
+		if child == nil {
+			child = &trieNode{children: map[string]*trieNode{}}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.topic = topic
+	node.terminal = true
+}
+
+// remove deletes the subscribed topic from the trie and prunes the branches
+// left without topics.
+func (t *topicTrie) remove(topic string) {
+	segments := strings.Split(topic, t.delimiter)
+	path := []*trieNode{t.root}
+	node := t.root
+	for _, segment := range segments {
+		node = node.children[segment]
+		if node == nil {
+			return
+		}
+		path = append(path, node)
+	}
+	node.terminal = false
+	node.topic = ""
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if child.terminal || len(child.children) > 0 {
+			return
+		}
+		delete(path[i].children, segments[i])
+	}
+}
+
+// match returns the subscribed topics matching the published topic. Each
+// topic is returned once.
+func (t *topicTrie) match(topic string) []string {
+	seen := map[string]bool{}
+	var topics []string
+	t.root.match(strings.Split(topic, t.delimiter), func(n *trieNode) {
+		if !seen[n.topic] {
+			seen[n.topic] = true
+			topics = append(topics, n.topic)
+		}
+	})
+	return topics
+}
+
+func (n *trieNode) match(segments []string, found func(n *trieNode)) {
+	if len(segments) == 0 {
+		if n.terminal {
+			found(n)
+		}
+	} else {
+		if child := n.children[segments[0]]; child != nil {
+			child.match(segments[1:], found)
+		}
+		if child := n.children[SingleWildcard]; child != nil {
+			child.match(segments[1:], found)
+		}
+	}
+
+	for _, wildcard := range []string{MultiWildcard, GlobWildcard} {
+		child := n.children[wildcard]
+		if child == nil {
+			continue
+		}
+		for i := 0; i <= len(segments); i++ {
+			child.match(segments[i:], found)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package pubsub_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_WildcardMatching(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		Wildcard: true,
+	})
+
+	subscribe := func(topic string) *pubsub.Subscriber {
+		sub := broker.AddSubscriber()
+		broker.Subscribe(sub, topic)
+		return sub
+	}
+	exact := subscribe("orders.eu.created")
+	single := subscribe("orders.*.created")
+	multi := subscribe("orders.#")
+	glob := subscribe("**.created")
+	middle := subscribe("orders.#.paid")
+
+	topics := []string{"orders.eu.created", "orders.us.created", "orders", "orders.eu.refund.paid", "users.created"}
+	for _, topic := range topics {
+		broker.Publish(topic, topic)
+	}
+
+	require.Equal(t, []any{"orders.eu.created"}, drain(exact))
+	require.Equal(t, []any{"orders.eu.created", "orders.us.created"}, drain(single))
+	require.Equal(t, []any{"orders.eu.created", "orders.us.created", "orders", "orders.eu.refund.paid"}, drain(multi))
+	require.Equal(t, []any{"orders.eu.created", "orders.us.created", "users.created"}, drain(glob))
+	require.Equal(t, []any{"orders.eu.refund.paid"}, drain(middle))
+}
+
+func Test_WildcardUnsubscribe(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		Wildcard:  true,
+		Delimiter: "/",
+	})
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "sensors/*/temp")
+	broker.Subscribe(sub, "sensors/#")
+
+	broker.Publish("sensors/kitchen/temp", 21)
+	require.Equal(t, 21, (<-sub.GetMessages()).GetContent())
+
+	broker.Unsubscribe(sub, "sensors/#")
+	broker.Unsubscribe(sub, "sensors/*/temp")
+	require.Equal(t, 0, broker.GetSubscribers("sensors/#"))
+
+	broker.Publish("sensors/kitchen/temp", 22)
+	require.Empty(t, drain(sub))
+}
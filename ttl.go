@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	// ExpiredTopicHeader is the header holding the topic of an expired
+	// message routed to the expiry topic.
+	ExpiredTopicHeader = "expired-topic"
+	// ExpiredSubscriberHeader is the header holding the ID of the subscriber
+	// an expired message routed to the expiry topic did not reach.
+	ExpiredSubscriberHeader = "expired-subscriber"
+)
+
+// ExpireHandler is called for every message that expires before reaching a
+// subscriber.
+type ExpireHandler func(s *Subscriber, msg *Message)
+
+// WithTTL sets how long the message may wait before reaching a subscriber,
+// overriding the default TTL of its topic.
+//
+// A message expiring while it waits for a subscriber, in its queue, for a
+// redelivery or as a retained message, is dropped instead of being handed to
+// the subscriber, and counted by Subscriber.Expired. With an ExpiryTopic in
+// the broker options, it is also published to that topic.
+func WithTTL(ttl time.Duration) PublishOption {
+	return func(m *Message) {
+		m.ttl = ttl
+	}
+}
+
+// GetExpiresAt returns when the message expires, or the zero time when it
+// has no TTL.
+func (m *Message) GetExpiresAt() time.Time {
+	return m.expiresAt
+}
+
+// IsExpired reports whether the TTL of the message has elapsed.
+func (m *Message) IsExpired() bool {
+	return !m.expiresAt.IsZero() && !time.Now().Before(m.expiresAt)
+}
+
+// SetTopicTTL sets the default TTL of the messages published to the topic.
+// A TTL of zero removes it.
+func (b *Broker) SetTopicTTL(topic string, ttl time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if ttl <= 0 {
+		delete(b.ttls, topic)
+		return
+	}
+	b.ttls[topic] = ttl
+}
+
+// TopicTTL returns the default TTL of the messages published to the topic,
+// or zero when they do not expire.
+func (b *Broker) TopicTTL(topic string) time.Duration {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.ttls[topic]
+}
+
+// Expired returns the number of messages that expired before reaching a
+// subscriber of the broker. A message expiring for several subscribers counts
+// once for each of them.
+func (b *Broker) Expired() uint64 {
+	return b.expired.Load()
+}
+
+// Expired returns the number of messages that expired before reaching the
+// subscriber. A growing count reveals a subscriber that falls behind.
+func (s *Subscriber) Expired() uint64 {
+	return s.expired.Load()
+}
+
+// setExpiry computes when the message being published expires, from its TTL
+// or the default TTL of its topic.
+func (b *Broker) setExpiry(m *Message) {
+	if m.ttl <= 0 {
+		m.ttl = b.TopicTTL(m.topic)
+	}
+	if m.ttl > 0 {
+		m.expiresAt = m.publishedAt.Add(m.ttl)
+	}
+}
+
+// restoreExpiry sets the TTL of a message read back from a store.
+func (m *Message) restoreExpiry(ttl time.Duration) {
+	m.ttl = ttl
+	if ttl > 0 {
+		m.expiresAt = m.publishedAt.Add(ttl)
+	}
+}
+
+// expire drops the expired message instead of handing it to the subscriber.
+func (s *Subscriber) expire(m *Message) {
+	s.expired.Add(1)
+	m.settle()
+	m.ticket.release()
+	if m.broker != nil {
+		m.broker.expire(s, m)
+	}
+}
+
+// expire counts the expired message and routes it to the expiry topic.
+func (b *Broker) expire(s *Subscriber, m *Message) {
+	b.expired.Add(1)
+	if b.opt.OnExpire != nil {
+		b.opt.OnExpire(s, m)
+	}
+
+	topic := b.opt.ExpiryTopic
+	if topic == "" || m.topic == topic {
+		return
+	}
+	_, err := b.PublishWithOptions(topic, m.content,
+		WithHeaders(m.headers),
+		WithHeader(ExpiredTopicHeader, m.topic),
+		WithHeader(ExpiredSubscriberHeader, s.ID),
+		WithKey(m.key),
+		WithCausedBy(m),
+	)
+	if err != nil && !errors.Is(err, ErrBrokerClosed) {
+		log.Printf("pubsub: route expired message %s: %v\n", m.id, err)
+	}
+}
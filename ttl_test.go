@@ -0,0 +1,103 @@
+package pubsub_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinh-tinh/pubsub/v2"
+)
+
+func Test_TTL(t *testing.T) {
+	var expired atomic.Int32
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{
+		TopicTTL: map[string]time.Duration{"prices": 30 * time.Millisecond},
+		OnExpire: func(s *pubsub.Subscriber, msg *pubsub.Message) {
+			expired.Add(1)
+		},
+	})
+	require.Equal(t, 30*time.Millisecond, broker.TopicTTL("prices"))
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "prices")
+	broker.Subscribe(sub, "news")
+
+	result, err := broker.PublishWithOptions("prices", 1)
+	require.Nil(t, err)
+	broker.PublishWithOptions("prices", 2, pubsub.WithTTL(time.Hour))
+	broker.Publish("news", "no ttl")
+
+	// Nobody reads while the messages wait in the queue of the subscriber.
+	time.Sleep(50 * time.Millisecond)
+
+	msg := <-sub.GetMessages()
+	require.Equal(t, 2, msg.GetContent())
+	require.False(t, msg.IsExpired())
+	require.WithinDuration(t, msg.GetPublishedAt().Add(time.Hour), msg.GetExpiresAt(), 0)
+	msg = <-sub.GetMessages()
+	require.Equal(t, "no ttl", msg.GetContent())
+	require.True(t, msg.GetExpiresAt().IsZero())
+	require.Empty(t, drain(sub))
+
+	require.Equal(t, uint64(1), sub.Expired())
+	require.Equal(t, uint64(1), broker.Expired())
+	require.Equal(t, int32(1), expired.Load())
+	require.NotEmpty(t, result.ID)
+
+	broker.SetTopicTTL("prices", 0)
+	require.Zero(t, broker.TopicTTL("prices"))
+	broker.Publish("prices", 3)
+	time.Sleep(40 * time.Millisecond)
+	require.Equal(t, []any{3}, drain(sub))
+}
+
+func Test_TTLExpiryTopic(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{ExpiryTopic: "expired"})
+	audit := broker.AddSubscriber()
+	broker.Subscribe(audit, "expired")
+
+	slow := broker.AddSubscriber()
+	broker.Subscribe(slow, "prices")
+	broker.Subscribe(slow, "expired")
+
+	result, err := broker.PublishWithOptions("prices", 42,
+		pubsub.WithTTL(20*time.Millisecond),
+		pubsub.WithHeader("source", "feed"),
+	)
+	require.Nil(t, err)
+	require.Equal(t, 1, result.Delivered)
+
+	// The stale message waits in the queue of the slow subscriber until it
+	// expires, and is routed to the expiry topic instead.
+	time.Sleep(40 * time.Millisecond)
+	msg := <-audit.GetMessages()
+	require.Equal(t, 42, msg.GetContent())
+	require.Equal(t, "prices", msg.GetHeader(pubsub.ExpiredTopicHeader))
+	require.Equal(t, slow.ID, msg.GetHeader(pubsub.ExpiredSubscriberHeader))
+	require.Equal(t, "feed", msg.GetHeader("source"))
+	require.Equal(t, result.ID, msg.GetCausationID())
+	require.True(t, msg.GetExpiresAt().IsZero())
+
+	msg = <-slow.GetMessages()
+	require.Equal(t, "expired", msg.GetTopic())
+	require.Empty(t, drain(slow))
+	require.Equal(t, uint64(1), slow.Expired())
+	require.Zero(t, audit.Expired())
+}
+
+func Test_TTLRetained(t *testing.T) {
+	broker := pubsub.NewBroker(pubsub.BrokerOptions{})
+	broker.PublishWithOptions("prices", 1, pubsub.WithRetain(), pubsub.WithTTL(20*time.Millisecond))
+	_, ok := broker.Retained("prices")
+	require.True(t, ok)
+
+	time.Sleep(30 * time.Millisecond)
+	_, ok = broker.Retained("prices")
+	require.False(t, ok)
+
+	sub := broker.AddSubscriber()
+	broker.Subscribe(sub, "prices")
+	require.Empty(t, drain(sub))
+	require.Zero(t, sub.Expired())
+}